@@ -0,0 +1,146 @@
+// Package access contains an inventory.Authorizer that verifies JSON Web Tokens and determines permissions
+// using the rules of a policy file.
+package access
+
+import (
+	"crypto"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/puppetlabs/inventory/inventory"
+	"github.com/sirupsen/logrus"
+)
+
+// reloadInterval is the minimum time between two checks for modifications of the policy file
+const reloadInterval = time.Second
+
+// Option is an option for the Authorizer
+type Option func(*Authorizer) error
+
+// HMACSecret adds a secret that is used when verifying tokens signed with HS256, HS384, or HS512
+func HMACSecret(secret []byte) Option {
+	return func(a *Authorizer) error {
+		a.verifier.secrets = append(a.verifier.secrets, secret)
+		return nil
+	}
+}
+
+// PublicKeys adds RSA or ECDSA public keys that are used when verifying tokens signed with RS, PS, or ES
+// algorithms
+func PublicKeys(keys ...crypto.PublicKey) Option {
+	return func(a *Authorizer) error {
+		a.verifier.publicKeys = append(a.verifier.publicKeys, keys...)
+		return nil
+	}
+}
+
+// PublicKeyFile adds the public key read from the given PEM file. The file may contain a public key or a
+// certificate.
+func PublicKeyFile(path string) Option {
+	return func(a *Authorizer) error {
+		key, err := readPublicKey(path)
+		if err == nil {
+			a.verifier.publicKeys = append(a.verifier.publicKeys, key)
+		}
+		return err
+	}
+}
+
+// Authorizer is an inventory.Authorizer that verifies the JSON Web Token found in the access token of the
+// client and determines its permission using the rules of a policy file. The policy file is reloaded when
+// it changes.
+type Authorizer struct {
+	verifier verifier
+	path     string
+	lock     sync.Mutex
+	policy   *policy
+	modTime  time.Time
+	checked  time.Time
+}
+
+// New creates an Authorizer that uses the policy file at the given path
+func New(policyFile string, options ...Option) (*Authorizer, error) {
+	a := &Authorizer{path: policyFile}
+	for _, o := range options {
+		if err := o(a); err != nil {
+			return nil, err
+		}
+	}
+	fi, err := os.Stat(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	if a.policy, err = readPolicy(policyFile); err != nil {
+		return nil, err
+	}
+	a.modTime = fi.ModTime()
+	a.checked = time.Now()
+	return a, nil
+}
+
+// Permission returns the permission that the client with the given access token has on the resource
+// appointed by the given key. The token is either the JWT string or an object with a "jwt" or "token"
+// property that holds it. A client with a missing or invalid token is anonymous.
+func (a *Authorizer) Permission(token json.RawMessage, key, realm string) inventory.Permission {
+	var claims Claims
+	if jwt := jwtOf(token); jwt != `` {
+		var err error
+		if claims, err = a.verifier.verify(jwt, time.Now()); err != nil {
+			logrus.Debugf(`access token rejected: %s`, err.Error())
+			claims = nil
+		}
+	}
+	return a.currentPolicy().permission(claims, key, realm)
+}
+
+// currentPolicy returns the policy, reloaded first if the policy file has changed since it was read. A policy
+// file that cannot be read is logged and the previous policy remains in effect.
+func (a *Authorizer) currentPolicy() *policy {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	if now.Sub(a.checked) < reloadInterval {
+		return a.policy
+	}
+	a.checked = now
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		logrus.Errorf(`unable to stat policy file %s: %s`, a.path, err.Error())
+		return a.policy
+	}
+	if fi.ModTime().Equal(a.modTime) {
+		return a.policy
+	}
+	a.modTime = fi.ModTime()
+	p, err := readPolicy(a.path)
+	if err != nil {
+		logrus.Errorf(`unable to reload policy file %s: %s`, a.path, err.Error())
+		return a.policy
+	}
+	logrus.Infof(`reloaded policy file %s`, a.path)
+	a.policy = p
+	return p
+}
+
+func jwtOf(token json.RawMessage) string {
+	if len(token) == 0 {
+		return ``
+	}
+	var s string
+	if json.Unmarshal(token, &s) == nil {
+		return s
+	}
+	var o struct {
+		JWT   string `json:"jwt"`
+		Token string `json:"token"`
+	}
+	if json.Unmarshal(token, &o) == nil {
+		if o.JWT != `` {
+			return o.JWT
+		}
+		return o.Token
+	}
+	return ``
+}
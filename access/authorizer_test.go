@@ -0,0 +1,127 @@
+package access_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	require "github.com/lyraproj/dgo/dgo_test"
+	"github.com/puppetlabs/inventory/access"
+	"github.com/puppetlabs/inventory/inventory"
+)
+
+var secret = []byte(`not so secret`)
+
+const policy = `
+default: read
+rules:
+  - subjects: [alice]
+    realms: [realm_a]
+    access: call
+  - groups: [admins]
+    access: reveal
+  - prefix: realm_b.secrets
+    access: none
+`
+
+func TestPermission_anonymous(t *testing.T) {
+	a := newAuthorizer(policy, t)
+	require.Equal(t, inventory.ReadAccess, a.Permission(nil, `realm_a.nodes`, `realm_a`))
+	require.Equal(t, inventory.NoAccess, a.Permission(nil, `realm_b.secrets`, `realm_b`))
+	require.Equal(t, inventory.NoAccess, a.Permission(nil, `realm_b.secrets.x`, `realm_b`))
+	require.Equal(t, inventory.ReadAccess, a.Permission(nil, `realm_b.secretsx`, `realm_b`))
+}
+
+func TestPermission_subject(t *testing.T) {
+	a := newAuthorizer(policy, t)
+	tk := token(map[string]interface{}{`sub`: `alice`}, secret)
+	require.Equal(t, inventory.CallAccess, a.Permission(tk, `realm_a.nodes`, `realm_a`))
+	require.Equal(t, inventory.ReadAccess, a.Permission(tk, `realm_b.nodes`, `realm_b`))
+}
+
+func TestPermission_group(t *testing.T) {
+	a := newAuthorizer(policy, t)
+	tk := token(map[string]interface{}{`sub`: `bob`, `groups`: []string{`devs`, `admins`}}, secret)
+	require.Equal(t, inventory.RevealAccess, a.Permission(tk, `realm_b.secrets`, `realm_b`))
+}
+
+func TestPermission_tokenObject(t *testing.T) {
+	a := newAuthorizer(policy, t)
+	jwt := token(map[string]interface{}{`sub`: `alice`}, secret)
+	tk, _ := json.Marshal(map[string]json.RawMessage{`jwt`: jwt})
+	require.Equal(t, inventory.CallAccess, a.Permission(tk, `realm_a.nodes`, `realm_a`))
+}
+
+func TestPermission_invalidSignature(t *testing.T) {
+	a := newAuthorizer(policy, t)
+	tk := token(map[string]interface{}{`sub`: `alice`}, []byte(`wrong secret`))
+	require.Equal(t, inventory.ReadAccess, a.Permission(tk, `realm_a.nodes`, `realm_a`))
+}
+
+func TestPermission_expired(t *testing.T) {
+	a := newAuthorizer(policy, t)
+	tk := token(map[string]interface{}{`sub`: `alice`, `exp`: time.Now().Add(-time.Hour).Unix()}, secret)
+	require.Equal(t, inventory.ReadAccess, a.Permission(tk, `realm_a.nodes`, `realm_a`))
+}
+
+func TestPermission_reload(t *testing.T) {
+	a := newAuthorizer(policy, t)
+	path := policyPath(t)
+	require.Equal(t, inventory.ReadAccess, a.Permission(nil, `realm_a.nodes`, `realm_a`))
+
+	writePolicy(path, `default: none`, time.Now().Add(time.Minute), t)
+	time.Sleep(1100 * time.Millisecond)
+	require.Equal(t, inventory.NoAccess, a.Permission(nil, `realm_a.nodes`, `realm_a`))
+
+	// An invalid policy is ignored and the previous policy remains in effect
+	writePolicy(path, `default: all`, time.Now().Add(2*time.Minute), t)
+	time.Sleep(1100 * time.Millisecond)
+	require.Equal(t, inventory.NoAccess, a.Permission(nil, `realm_a.nodes`, `realm_a`))
+}
+
+func TestNew_invalidPolicy(t *testing.T) {
+	path := policyPath(t)
+	writePolicy(path, `rules: [{access: sometimes}]`, time.Now(), t)
+	_, err := access.New(path, access.HMACSecret(secret))
+	require.NotNil(t, err)
+}
+
+func newAuthorizer(content string, t *testing.T) *access.Authorizer {
+	t.Helper()
+	path := policyPath(t)
+	writePolicy(path, content, time.Now(), t)
+	a, err := access.New(path, access.HMACSecret(secret))
+	require.Ok(t, err)
+	return a
+}
+
+func policyPath(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.Abs(filepath.Join(`..`, `testdata`, `volatile`, `access`))
+	require.Ok(t, err)
+	require.Ok(t, os.MkdirAll(dir, 0750))
+	return filepath.Join(dir, t.Name()+`.yaml`)
+}
+
+func writePolicy(path, content string, modTime time.Time, t *testing.T) {
+	t.Helper()
+	require.Ok(t, ioutil.WriteFile(path, []byte(content), 0600))
+	require.Ok(t, os.Chtimes(path, modTime, modTime))
+}
+
+// token returns a JSON string containing a HS256 signed JWT with the given claims
+func token(claims map[string]interface{}, key []byte) json.RawMessage {
+	enc := base64.RawURLEncoding
+	cb, _ := json.Marshal(claims)
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + `.` + enc.EncodeToString(cb)
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(signed))
+	tk, _ := json.Marshal(signed + `.` + enc.EncodeToString(mac.Sum(nil)))
+	return tk
+}
@@ -0,0 +1,200 @@
+package access
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// leeway is the clock skew that is tolerated when validating the exp and nbf claims
+const leeway = 30 * time.Second
+
+// Claims are the claims of a verified JSON Web Token
+type Claims map[string]interface{}
+
+// Subject returns the sub claim or an empty string if no such claim exists
+func (c Claims) Subject() string {
+	s, _ := c[`sub`].(string)
+	return s
+}
+
+// Strings returns the claim with the given name as a slice of strings. A single string is returned as a
+// one element slice.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// verifier verifies the signatures of JSON Web Tokens using HMAC secrets and RSA or ECDSA public keys
+type verifier struct {
+	secrets    [][]byte
+	publicKeys []crypto.PublicKey
+}
+
+// verify verifies the signature and the exp and nbf claims of the given token and returns its claims
+func (v *verifier) verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, `.`)
+	if len(parts) != 3 {
+		return nil, errors.New(`token is not a JWT`)
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf(`invalid JWT header: %s`, err.Error())
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf(`invalid JWT signature: %s`, err.Error())
+	}
+	if err = v.verifySignature(header.Alg, []byte(parts[0]+`.`+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf(`invalid JWT claims: %s`, err.Error())
+	}
+	if exp, ok := claims[`exp`].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, errors.New(`token has expired`)
+	}
+	if nbf, ok := claims[`nbf`].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New(`token is not yet valid`)
+	}
+	return claims, nil
+}
+
+func (v *verifier) verifySignature(alg string, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf(`unsupported JWT algorithm %q`, alg)
+	}
+	var hf crypto.Hash
+	switch alg[2:] {
+	case `256`:
+		hf = crypto.SHA256
+	case `384`:
+		hf = crypto.SHA384
+	case `512`:
+		hf = crypto.SHA512
+	default:
+		return fmt.Errorf(`unsupported JWT algorithm %q`, alg)
+	}
+	switch alg[:2] {
+	case `HS`:
+		for _, secret := range v.secrets {
+			mac := hmac.New(hashFunc(hf), secret)
+			_, _ = mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), sig) {
+				return nil
+			}
+		}
+	case `RS`, `PS`, `ES`:
+		h := hf.New()
+		_, _ = h.Write(signed)
+		digest := h.Sum(nil)
+		for _, key := range v.publicKeys {
+			if verifyDigest(alg[:2], key, hf, digest, sig) {
+				return nil
+			}
+		}
+	default:
+		return fmt.Errorf(`unsupported JWT algorithm %q`, alg)
+	}
+	return errors.New(`invalid JWT signature`)
+}
+
+func verifyDigest(family string, key crypto.PublicKey, hf crypto.Hash, digest, sig []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch family {
+		case `RS`:
+			return rsa.VerifyPKCS1v15(key, hf, digest, sig) == nil
+		case `PS`:
+			return rsa.VerifyPSS(key, hf, digest, sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		if family == `ES` && len(sig)%2 == 0 {
+			n := len(sig) / 2
+			return ecdsa.Verify(key, digest, new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:]))
+		}
+	}
+	return false
+}
+
+func hashFunc(hf crypto.Hash) func() hash.Hash {
+	switch hf {
+	case crypto.SHA384:
+		return sha512.New384
+	case crypto.SHA512:
+		return sha512.New
+	default:
+		return sha256.New
+	}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// readPublicKey reads a PEM encoded public key or certificate from the given file
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	/* #nosec */
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf(`%s: no PEM data found`, path)
+	}
+	switch block.Type {
+	case `CERTIFICATE`:
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf(`%s: %s`, path, err.Error())
+		}
+		return cert.PublicKey, nil
+	case `RSA PUBLIC KEY`:
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf(`%s: %s`, path, err.Error())
+		}
+		return key, nil
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf(`%s: %s`, path, err.Error())
+		}
+		return key, nil
+	}
+}
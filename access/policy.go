@@ -0,0 +1,130 @@
+package access
+
+import (
+	"strings"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/tf"
+	"github.com/puppetlabs/inventory/inventory"
+	"github.com/puppetlabs/inventory/yaml"
+)
+
+var policyFileType = tf.ParseType(`{
+	default?: "none"|"read"|"call"|"reveal",
+	rules?: []{
+		subjects?: []string[1],
+		groups?: []string[1],
+		realms?: []string[1],
+		prefix?: string[1],
+		access: "none"|"read"|"call"|"reveal"
+	}
+}`)
+
+var permissions = map[string]inventory.Permission{
+	`none`:   inventory.NoAccess,
+	`read`:   inventory.ReadAccess,
+	`call`:   inventory.CallAccess,
+	`reveal`: inventory.RevealAccess,
+}
+
+// policy is the parsed contents of a policy file
+type policy struct {
+	dflt  inventory.Permission
+	rules []*rule
+}
+
+// rule grants a permission to the clients that matches its subjects or groups, on the resources that matches its
+// realms and prefix. An absent subjects, groups, realms, or prefix matches everything.
+type rule struct {
+	subjects   []string
+	groups     []string
+	realms     []string
+	prefix     string
+	permission inventory.Permission
+}
+
+// readPolicy reads and validates the policy file at the given path
+func readPolicy(path string) (*policy, error) {
+	data, err := yaml.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if !policyFileType.Instance(data) {
+		return nil, tf.IllegalAssignment(policyFileType, data).(error)
+	}
+	p := &policy{dflt: inventory.NoAccess}
+	if d, ok := data.Get(`default`).(dgo.String); ok {
+		p.dflt = permissions[d.GoString()]
+	}
+	if rules, ok := data.Get(`rules`).(dgo.Array); ok {
+		rules.Each(func(rv dgo.Value) {
+			rm := rv.(dgo.Map)
+			r := &rule{
+				subjects:   stringSlice(rm.Get(`subjects`)),
+				groups:     stringSlice(rm.Get(`groups`)),
+				realms:     stringSlice(rm.Get(`realms`)),
+				permission: permissions[rm.Get(`access`).String()],
+			}
+			if pfx, ok := rm.Get(`prefix`).(dgo.String); ok {
+				r.prefix = pfx.GoString()
+			}
+			p.rules = append(p.rules, r)
+		})
+	}
+	return p, nil
+}
+
+// permission returns the permission granted by the first rule that matches the given claims, key, and realm,
+// or the default permission when no rule matches. The claims are nil for anonymous clients.
+func (p *policy) permission(claims Claims, key, realm string) inventory.Permission {
+	for _, r := range p.rules {
+		if r.matchesClient(claims) && r.matchesResource(key, realm) {
+			return r.permission
+		}
+	}
+	return p.dflt
+}
+
+func (r *rule) matchesClient(claims Claims) bool {
+	if r.subjects == nil && r.groups == nil {
+		return true
+	}
+	if claims == nil {
+		return false
+	}
+	if contains(r.subjects, claims.Subject()) {
+		return true
+	}
+	for _, g := range claims.Strings(`groups`) {
+		if contains(r.groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchesResource(key, realm string) bool {
+	if r.realms != nil && !contains(r.realms, realm) {
+		return false
+	}
+	return r.prefix == `` || key == r.prefix || strings.HasPrefix(key, r.prefix+`.`)
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stringSlice(v dgo.Value) []string {
+	a, ok := v.(dgo.Array)
+	if !ok {
+		return nil
+	}
+	ss := make([]string, a.Len())
+	a.EachWithIndex(func(e dgo.Value, i int) { ss[i] = e.String() })
+	return ss
+}
@@ -6,11 +6,15 @@ import (
 )
 
 var configV = vf.String(`config`)
+var errorsV = vf.String(`errors`)
 var factsV = vf.String(`facts`)
 var featuresV = vf.String(`features`)
 var idV = vf.String(`id`)
 var nameV = vf.String(`name`)
+var targetV = vf.String(`target`)
+var toV = vf.String(`to`)
 var varsV = vf.String(`vars`)
+var watchV = vf.String(`watch`)
 
 // A Data interface is implemented by group and target
 type Data interface {
@@ -0,0 +1,379 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/iapi"
+	"github.com/puppetlabs/inventory/yaml"
+)
+
+// computedKeys are the keys of a merged target that are computed and hence cannot be changed
+var computedKeys = vf.Values(idV, realmV, groupsV)
+
+// errPluginReference is returned when a model given by a client contains a plugin reference. Only the
+// inventory files may declare references since resolving them runs plugins.
+var errPluginReference = iapi.InvalidData{Reason: `plugin references cannot be set by clients`}
+
+// applyChange writes the given model into the most specific declaration of the target with the given
+// name. The most specific declaration is the one that takes precedence when the declarations are merged.
+// A declaration made using a string reference is replaced by a new inline target map in the same group.
+//
+// The path is a list of keys that leads from the target declaration to the map that will receive the
+// model. Maps are created as needed.
+func (r *realm) applyChange(ctx context.Context, name string, path []string, model dgo.Map) error {
+	decls, ok := r.unmergedTargets.Get(name).(dgo.Array)
+	if !ok || decls.Len() == 0 {
+		return iapi.NotFound(name)
+	}
+	if len(path) == 0 {
+		model = model.WithoutAll(computedKeys)
+	}
+	if model.Len() == 0 {
+		return nil
+	}
+	if containsReference(model) {
+		return errPluginReference
+	}
+
+	doc := r.data.Copy(false)
+	t := decls.Get(decls.Len() - 1).(*trg)
+	tgs, ok := groupInput(doc, t.parent).Get(targetsV).(dgo.Array)
+	if !ok {
+		return fmt.Errorf(`unable to find declaration of target %s in %s`, name, r.path)
+	}
+	ti := targetIndex(tgs, t)
+	if ti < 0 {
+		return fmt.Errorf(`unable to find declaration of target %s in %s`, name, r.path)
+	}
+	tm, ok := tgs.Get(ti).(dgo.Map)
+	if !ok {
+		// Replace the string reference with an inline declaration
+		tm = t.input.Copy(false)
+		tgs.Set(ti, tm)
+	}
+	container := tm
+	for _, key := range path {
+		next, ok := container.Get(key).(dgo.Map)
+		if !ok {
+			next = vf.MutableMap()
+			container.Put(key, next)
+		}
+		container = next
+	}
+	container.PutAll(DeepMerge(container, model))
+	return r.write(ctx, doc)
+}
+
+// deleteTarget removes all declarations of the target with the given name together with all string
+// references to it, by name or by alias, from the realm file. It returns false if no such target exists.
+func (r *realm) deleteTarget(ctx context.Context, name string) (bool, error) {
+	if !r.unmergedTargets.ContainsKey(name) {
+		return false, nil
+	}
+	n := vf.String(name)
+	refs := vf.MutableValues(n)
+	r.aliases.EachEntry(func(e dgo.MapEntry) {
+		if n.Equals(e.Value()) {
+			refs.Add(e.Key())
+		}
+	})
+	doc := r.data.Copy(false)
+	rejectTargets(doc, func(tv dgo.Value) bool {
+		if tm, ok := tv.(dgo.Map); ok {
+			tn := tm.Get(nameV)
+			if tn == nil {
+				tn = tm.Get(uriV)
+			}
+			return n.Equals(tn)
+		}
+		return refs.IndexOf(tv) >= 0
+	})
+	if err := r.write(ctx, doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteGroup removes the group with the given name, and everything it contains, from the realm file. It
+// returns false if no such group exists.
+func (r *realm) deleteGroup(ctx context.Context, name string) (bool, error) {
+	doc := r.data.Copy(false)
+	if !removeGroupInput(doc, vf.String(name)) {
+		return false, nil
+	}
+	if err := r.write(ctx, doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rejectTargets removes all elements that matches the given predicate from all targets arrays found in the
+// given group map and the groups beneath it.
+func rejectTargets(gm dgo.Map, predicate dgo.Predicate) {
+	if tgs, ok := gm.Get(targetsV).(dgo.Array); ok {
+		gm.Put(targetsV, tgs.Reject(predicate))
+	}
+	if gs, ok := gm.Get(groupsV).(dgo.Array); ok {
+		gs.Each(func(g dgo.Value) { rejectTargets(g.(dgo.Map), predicate) })
+	}
+}
+
+// removeGroupInput removes the first group with the given name that is found in the given group map or the
+// groups beneath it.
+func removeGroupInput(gm dgo.Map, name dgo.String) bool {
+	gs, ok := gm.Get(groupsV).(dgo.Array)
+	if !ok {
+		return false
+	}
+	for i, n := 0, gs.Len(); i < n; i++ {
+		sg := gs.Get(i).(dgo.Map)
+		if name.Equals(sg.Get(nameV)) {
+			gs.Remove(i)
+			return true
+		}
+		if removeGroupInput(sg, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// addGroup adds a new group, described by the given parameters, to the group with the given name.
+func (r *realm) addGroup(ctx context.Context, parent string, params dgo.Map) error {
+	name, err := stringParam(params, nameV)
+	if err != nil {
+		return err
+	}
+	if containsReference(params) {
+		return errPluginReference
+	}
+	doc := r.data.Copy(false)
+	gm := findGroupInput(doc, parent)
+	if gm == nil {
+		return iapi.NotFound(parent)
+	}
+	if findGroupInput(doc, name.GoString()) != nil {
+		return iapi.Conflict{Reason: fmt.Sprintf(`a group named %q already exists in realm %s`, name, r.contents.Name())}
+	}
+	gs, ok := gm.Get(groupsV).(dgo.Array)
+	if !ok {
+		gs = vf.MutableValues()
+		gm.Put(groupsV, gs)
+	}
+	gs.Add(params.Copy(false))
+	return r.write(ctx, doc)
+}
+
+// removeGroup removes the group appointed by the name parameter from the group with the given name.
+func (r *realm) removeGroup(ctx context.Context, parent string, params dgo.Map) error {
+	name, err := stringParam(params, nameV)
+	if err != nil {
+		return err
+	}
+	doc := r.data.Copy(false)
+	gm := findGroupInput(doc, parent)
+	if gm == nil {
+		return iapi.NotFound(parent)
+	}
+	if gs, ok := gm.Get(groupsV).(dgo.Array); ok {
+		for i, n := 0, gs.Len(); i < n; i++ {
+			if name.Equals(gs.Get(i).(dgo.Map).Get(nameV)) {
+				gs.Remove(i)
+				return r.write(ctx, doc)
+			}
+		}
+	}
+	return iapi.NotFound(name.GoString())
+}
+
+// addTarget adds a reference to the target appointed by the target parameter to the group with the
+// given name. The parameter can be the name, an alias, or the URI of the target. Nothing is added if
+// the group already contains the target.
+func (r *realm) addTarget(ctx context.Context, groupName string, params dgo.Map) error {
+	tn, err := stringParam(params, targetV)
+	if err != nil {
+		return err
+	}
+	if namePattern.Instance(tn) && !(r.unmergedTargets.ContainsKey(tn) || r.aliases.ContainsKey(tn)) {
+		return iapi.NotFound(tn.GoString())
+	}
+	if _, err = url.Parse(tn.GoString()); err != nil {
+		return iapi.InvalidData{Reason: fmt.Sprintf(`the string '%s' is not a valid URI: %s`, tn, err.Error())}
+	}
+	doc := r.data.Copy(false)
+	gm := findGroupInput(doc, groupName)
+	if gm == nil {
+		return iapi.NotFound(groupName)
+	}
+	tgs, ok := gm.Get(targetsV).(dgo.Array)
+	if !ok {
+		tgs = vf.MutableValues()
+		gm.Put(targetsV, tgs)
+	}
+	if tgs.Any(r.targetMatcher(tn)) {
+		return nil
+	}
+	tgs.Add(tn)
+	return r.write(ctx, doc)
+}
+
+// moveTarget moves all declarations of, and references to, the target appointed by the target parameter
+// from the group with the given name to the group appointed by the to parameter.
+func (r *realm) moveTarget(ctx context.Context, groupName string, params dgo.Map) error {
+	tn, err := stringParam(params, targetV)
+	if err != nil {
+		return err
+	}
+	to, err := stringParam(params, toV)
+	if err != nil {
+		return err
+	}
+	doc := r.data.Copy(false)
+	gm := findGroupInput(doc, groupName)
+	if gm == nil {
+		return iapi.NotFound(groupName)
+	}
+	dm := findGroupInput(doc, to.GoString())
+	if dm == nil {
+		return iapi.NotFound(to.GoString())
+	}
+	tgs, _ := gm.Get(targetsV).(dgo.Array)
+	if tgs == nil || !tgs.Any(r.targetMatcher(tn)) {
+		return iapi.NotFound(tn.GoString())
+	}
+	dts, ok := dm.Get(targetsV).(dgo.Array)
+	if !ok {
+		dts = vf.MutableValues()
+		dm.Put(targetsV, dts)
+	}
+	tgs.Select(r.targetMatcher(tn)).Each(func(tv dgo.Value) {
+		if _, ok := tv.(dgo.String); !ok || dts.IndexOf(tv) < 0 {
+			dts.Add(tv)
+		}
+	})
+	gm.Put(targetsV, tgs.Reject(r.targetMatcher(tn)))
+	return r.write(ctx, doc)
+}
+
+// targetMatcher returns a predicate that matches declarations of, and string references to, the target
+// appointed by the given name, alias, or URI.
+func (r *realm) targetMatcher(ref dgo.String) dgo.Predicate {
+	n := ref
+	if alias, ok := r.aliases.Get(ref).(dgo.String); ok {
+		n = alias
+	}
+	return func(tv dgo.Value) bool {
+		switch tv := tv.(type) {
+		case dgo.String:
+			if alias, ok := r.aliases.Get(tv).(dgo.String); ok {
+				return n.Equals(alias)
+			}
+			return n.Equals(tv)
+		case dgo.Map:
+			tn := tv.Get(nameV)
+			if tn == nil {
+				tn = tv.Get(uriV)
+			}
+			return n.Equals(tn)
+		}
+		return false
+	}
+}
+
+// findGroupInput returns the map of the group with the given name in the given group map or the groups
+// beneath it. The given group map is returned when the name is empty and nil is returned if no group
+// is found.
+func findGroupInput(gm dgo.Map, name string) dgo.Map {
+	if name == `` {
+		return gm
+	}
+	if gs, ok := gm.Get(groupsV).(dgo.Array); ok {
+		for i, n := 0, gs.Len(); i < n; i++ {
+			sg := gs.Get(i).(dgo.Map)
+			if sg.Get(nameV).Equals(name) {
+				return sg
+			}
+			if fg := findGroupInput(sg, name); fg != nil {
+				return fg
+			}
+		}
+	}
+	return nil
+}
+
+// stringParam returns the string parameter with the given name or an error if no such parameter exists.
+func stringParam(params dgo.Map, name dgo.String) (dgo.String, error) {
+	if s, ok := params.Get(name).(dgo.String); ok {
+		return s, nil
+	}
+	return nil, iapi.InvalidData{Reason: fmt.Sprintf(`missing required string parameter %q`, name)}
+}
+
+// write validates the given document and writes it to the realm file. The realm is then reloaded.
+func (r *realm) write(ctx context.Context, doc dgo.Map) error {
+	if r.err != nil {
+		return iapi.Conflict{
+			Reason: fmt.Sprintf(`realm %s cannot be changed until it can be read: %s`, r.contents.Name(), r.err.Error())}
+	}
+	if _, _, err := r.resolve(ctx, doc); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return iapi.InvalidData{Reason: err.Error()}
+	}
+	if err := yaml.Write(r.path, doc); err != nil {
+		return err
+	}
+	return r.reload(ctx, time.Now())
+}
+
+// groupInput returns the map in the given document that corresponds to the given group. Groups are
+// located by name, starting from the top level.
+func groupInput(doc dgo.Map, g Group) dgo.Map {
+	if g == nil {
+		return doc
+	}
+	parents := append(g.AllParents(), g)
+	m := doc
+	for _, p := range parents[1:] { // first parent is the realm itself
+		gs, ok := m.Get(groupsV).(dgo.Array)
+		if !ok {
+			return vf.Map()
+		}
+		n := p.Name()
+		gv := gs.Find(func(e dgo.Value) interface{} {
+			if gm, ok := e.(dgo.Map); ok && n.Equals(gm.Get(nameV)) {
+				return gm
+			}
+			return nil
+		})
+		if gv == nil {
+			return vf.Map()
+		}
+		m = gv.(dgo.Map)
+	}
+	return m
+}
+
+// targetIndex returns the index of the declaration of the given target in the given array of
+// target declarations or -1 if no such declaration is found.
+func targetIndex(tgs dgo.Array, t *trg) int {
+	if t.ref != nil {
+		return tgs.IndexOf(t.ref)
+	}
+	key, id := nameV, t.Name()
+	if id == nil {
+		key, id = uriV, t.URI()
+	}
+	for i, n := 0, tgs.Len(); i < n; i++ {
+		if tm, ok := tgs.Get(i).(dgo.Map); ok && id.Equals(tm.Get(key)) {
+			return i
+		}
+	}
+	return -1
+}
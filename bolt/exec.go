@@ -0,0 +1,186 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/streamer"
+	"github.com/lyraproj/dgo/vf"
+)
+
+const defaultPluginTimeout = 30 * time.Second
+const defaultPluginCacheTTL = 5 * time.Minute
+
+// PluginDir sets the directory where the executables of external plugins are found. An external plugin is
+// an executable file named after the plugin, optionally with an extension, e.g. "cmdb" or "cmdb.sh".
+func PluginDir(dir string) Option {
+	return func(s *storage) {
+		s.plugins.dir = dir
+	}
+}
+
+// PluginTimeout sets the maximum time that an external plugin is allowed to run. The default is 30 seconds.
+func PluginTimeout(timeout time.Duration) Option {
+	return func(s *storage) {
+		s.plugins.timeout = timeout
+	}
+}
+
+// PluginCacheTTL sets the time that the result of an external plugin is cached. The result is keyed by
+// the plugin name and a hash of its parameters. The default is five minutes. A zero duration disables the
+// cache.
+func PluginCacheTTL(ttl time.Duration) Option {
+	return func(s *storage) {
+		s.plugins.ttl = ttl
+	}
+}
+
+type cachedResult struct {
+	value   dgo.Value
+	expires time.Time
+}
+
+// execPlugins finds and runs external plugin executables
+type execPlugins struct {
+	dir     string
+	timeout time.Duration
+	ttl     time.Duration
+	lock    sync.Mutex
+	cache   map[string]cachedResult
+}
+
+// execPlugin is a Plugin that runs an external executable
+type execPlugin struct {
+	name    string
+	path    string
+	plugins *execPlugins
+}
+
+func newExecPlugins() *execPlugins {
+	return &execPlugins{timeout: defaultPluginTimeout, ttl: defaultPluginCacheTTL, cache: make(map[string]cachedResult)}
+}
+
+// lookup returns the plugin that runs the executable for the given name, or nil if no such executable
+// exists in the plugin directory or if the name isn't a valid plugin name.
+func (ep *execPlugins) lookup(name string) Plugin {
+	if ep == nil || ep.dir == `` || !validPluginName(name) {
+		return nil
+	}
+	if path := filepath.Join(ep.dir, name); isExecutable(path) {
+		return &execPlugin{name: name, path: path, plugins: ep}
+	}
+	matches, _ := filepath.Glob(filepath.Join(ep.dir, name+`.*`))
+	sort.Strings(matches)
+	for _, path := range matches {
+		if isExecutable(path) {
+			return &execPlugin{name: name, path: path, plugins: ep}
+		}
+	}
+	return nil
+}
+
+// validPluginName returns true if the given name matches the name pattern. Names that could appoint an
+// executable outside of the plugin directory are never valid.
+func validPluginName(name string) bool {
+	if strings.ContainsAny(name, `/\`) || strings.Contains(name, `..`) {
+		return false
+	}
+	return namePattern.Instance(vf.String(name))
+}
+
+// Resolve passes the parameters of the reference as a JSON object on stdin to the executable and parses
+// the JSON written by the executable on stdout. If the output is an object with a "value" key, then the
+// value of that key is the result. Otherwise, the output in its entirety is the result.
+func (p *execPlugin) Resolve(rc ResolveContext, params dgo.Map) (dgo.Value, error) {
+	input := streamer.MarshalJSON(params.Without(pluginV), nil)
+	key := p.name + `:` + hashOf(input)
+	if v, ok := p.plugins.cached(key); ok {
+		return v, nil
+	}
+	v, err := p.run(rc.Context(), input)
+	if err != nil {
+		return nil, err
+	}
+	p.plugins.store(key, v)
+	return v, nil
+}
+
+func (p *execPlugin) run(parent context.Context, input []byte) (result dgo.Value, err error) {
+	ctx, cancel := context.WithTimeout(parent, p.plugins.timeout)
+	defer cancel()
+
+	/* #nosec */
+	cmd := exec.CommandContext(ctx, p.path)
+	cmd.Dir = filepath.Dir(p.path)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if parent.Err() != nil {
+			return nil, parent.Err()
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf(`%s timed out after %s`, p.path, p.plugins.timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != `` {
+			return nil, fmt.Errorf(`%s: %s: %s`, p.path, err.Error(), msg)
+		}
+		return nil, fmt.Errorf(`%s: %s`, p.path, err.Error())
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf(`%s produced invalid JSON: %v`, p.path, e)
+		}
+	}()
+	result = streamer.UnmarshalJSON(stdout.Bytes(), nil)
+	if m, ok := result.(dgo.Map); ok {
+		if v := m.Get(valueV); v != nil {
+			result = v
+		}
+	}
+	return result, nil
+}
+
+func (ep *execPlugins) cached(key string) (dgo.Value, bool) {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if cr, ok := ep.cache[key]; ok {
+		if time.Now().Before(cr.expires) {
+			return cr.value, true
+		}
+		delete(ep.cache, key)
+	}
+	return nil, false
+}
+
+func (ep *execPlugins) store(key string, v dgo.Value) {
+	if ep.ttl <= 0 {
+		return
+	}
+	ep.lock.Lock()
+	ep.cache[key] = cachedResult{value: v, expires: time.Now().Add(ep.ttl)}
+	ep.lock.Unlock()
+}
+
+func hashOf(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func isExecutable(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0
+}
@@ -0,0 +1,154 @@
+package bolt
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/change"
+)
+
+const explain = `explain`
+
+var keyV = vf.String(`key`)
+var overridesV = vf.String(`overrides`)
+var sourceV = vf.String(`source`)
+var valueV = vf.String(`value`)
+
+// provenance keeps track of where each leaf of a merged map was declared. Leaves are keyed by their
+// dot separated path in the merged map.
+type provenance struct {
+	entries map[string]dgo.Map
+}
+
+// explain returns a Map that, for each leaf key in the merged config, facts, and vars of the target with the
+// given name, describes the winning value, the realm/group path of the declaration that supplied it, and the
+// values that it overrode, most recently overridden first.
+func (r *realm) explain(name string) dgo.Map {
+	decls, ok := r.unmergedTargets.Get(name).(dgo.Array)
+	if !ok {
+		return nil
+	}
+	config := &provenance{entries: make(map[string]dgo.Map)}
+	facts := &provenance{entries: make(map[string]dgo.Map)}
+	vars := &provenance{entries: make(map[string]dgo.Map)}
+	decls.Each(func(tv dgo.Value) {
+		t := tv.(*trg)
+		for _, d := range append(dataSlice(t.AllParents()), t) {
+			source := sourcePath(d)
+			config.layer(``, d.LocalConfig(), source, true)
+			facts.layer(``, d.LocalFacts(), source, true)
+			vars.layer(``, d.LocalVars(), source, false)
+		}
+	})
+	return vf.Map(configV, config.result(), factsV, facts.result(), varsV, vars.result())
+}
+
+// explainResets appends a Reset modification for the explain resource of each target that is changed by
+// the given modifications, and returns the result.
+func explainResets(mods []*change.Modification) []*change.Modification {
+	seen := make(map[string]bool)
+	tp := target + `.`
+	for _, mod := range mods {
+		if mod.Type == change.Delete || !strings.HasPrefix(mod.ResourceName, tp) {
+			continue
+		}
+		id := strings.SplitN(mod.ResourceName[len(tp):], `.`, 2)[0]
+		if !seen[id] {
+			seen[id] = true
+			mods = append(mods, &change.Modification{ResourceName: tp + id + `.` + explain, Type: change.Reset})
+		}
+	}
+	return mods
+}
+
+func (p *provenance) layer(prefix string, m dgo.Map, source string, deep bool) {
+	m.EachEntry(func(e dgo.MapEntry) {
+		k := prefix + e.Key().String()
+		v := e.Value()
+		if vm, ok := v.(dgo.Map); ok && deep {
+			if vm.Len() > 0 {
+				// The map is merged with an existing map or replaces an existing leaf
+				delete(p.entries, k)
+				p.layer(k+`.`, vm, source, deep)
+				return
+			}
+			if p.hasPrefix(k + `.`) {
+				// Merging an empty map with an existing map is a no-op
+				return
+			}
+		}
+		p.removePrefix(k + `.`)
+		p.set(k, v, source)
+	})
+}
+
+func (p *provenance) set(k string, v dgo.Value, source string) {
+	if old, ok := p.entries[k]; ok {
+		if source == old.Get(sourceV).String() && v.Equals(old.Get(valueV)) {
+			// The ancestors of a target that is declared more than once are layered once per declaration
+			return
+		}
+		overrides := old.Get(overridesV).(dgo.Array)
+		overrides.Insert(0, vf.Map(valueV, old.Get(valueV), sourceV, old.Get(sourceV)))
+		old.Put(valueV, v)
+		old.Put(sourceV, source)
+		return
+	}
+	p.entries[k] = vf.MutableMap(keyV, k, valueV, v, sourceV, source, overridesV, vf.MutableValues())
+}
+
+func (p *provenance) hasPrefix(prefix string) bool {
+	for k := range p.entries {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *provenance) removePrefix(prefix string) {
+	for k := range p.entries {
+		if strings.HasPrefix(k, prefix) {
+			delete(p.entries, k)
+		}
+	}
+}
+
+// result returns the entries as an Array sorted by key
+func (p *provenance) result() dgo.Array {
+	keys := make([]string, 0, len(p.entries))
+	for k := range p.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	a := vf.ArrayWithCapacity(len(keys))
+	for _, k := range keys {
+		a.Add(p.entries[k])
+	}
+	return a
+}
+
+func dataSlice(groups []Group) []Data {
+	ds := make([]Data, len(groups))
+	for i, g := range groups {
+		ds[i] = g
+	}
+	return ds
+}
+
+// sourcePath returns the names of all parents of the given data, and the data itself, joined with slashes.
+// Targets without a name are represented by their URI.
+func sourcePath(d Data) string {
+	ps := d.AllParents()
+	ns := make([]string, 0, len(ps)+1)
+	for _, p := range ps {
+		ns = append(ns, p.Name().GoString())
+	}
+	n := d.Name()
+	if t, ok := d.(Target); ok && n == nil {
+		n = t.URI()
+	}
+	return strings.Join(append(ns, n.GoString()), `/`)
+}
@@ -9,12 +9,15 @@ import (
 	"github.com/lyraproj/dgo/dgo"
 	"github.com/lyraproj/dgo/tf"
 	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/change"
+	"github.com/puppetlabs/inventory/iapi"
 	"github.com/sirupsen/logrus"
 )
 
 // A Group interface is implemented by the group
 type Group interface {
 	Data
+	iapi.Resource
 
 	// CollectTargets collects all Target aliases into a map where the key is a alias and the value
 	// is the name of the target declaring that alias
@@ -24,6 +27,22 @@ type Group interface {
 	// an Array of all Target declarations found by that key.
 	CollectTargets(dgo.Map)
 
+	// Config returns a frozen deep merge of the config that this group and its parent groups have
+	// declared. Mappings found in a child take precedence over mappings in parent.
+	Config() dgo.Map
+
+	// Facts returns a frozen deep merge of the facts that this group and its parent groups have
+	// declared. Mappings found in a child take precedence over mappings in parent.
+	Facts() dgo.Map
+
+	// Features returns a frozen, unique, and sorted array of features that this group and its parent
+	// groups have declared.
+	Features() dgo.Array
+
+	// Vars returns a frozen shallow merge of the vars that this group and its parent groups have
+	// declared. Mappings found in a child take precedence over mappings in parent.
+	Vars() dgo.Map
+
 	// LocalGroups returns an Array of Group instances that is parented by this Group
 	LocalGroups() dgo.Array
 
@@ -44,6 +63,15 @@ type group struct {
 	groups        dgo.Array
 	targets       dgo.Array
 	stringTargets dgo.Array
+	dataMap       dgo.Map
+
+	// The config, facts, features, and vars merged from the top level down to this group. They are
+	// computed once when the group is created so that targets only need to merge their own declarations
+	// with those of their parent. A reload of the realm creates new groups, which invalidates them.
+	config   dgo.Map
+	facts    dgo.Map
+	features dgo.Array
+	vars     dgo.Map
 }
 
 var groupType = tf.NewNamed(
@@ -61,6 +89,7 @@ var targetsV = vf.String(`targets`)
 // NewGroup creates a new Group based on the given input
 func NewGroup(parent Group, input dgo.Map) Group {
 	g := &group{dta: dta{input: input, parent: parent}}
+	g.mergeParent()
 	if targets, ok := g.input.Get(targetsV).(dgo.Array); ok {
 		targets.Each(func(st dgo.Value) {
 			if _, ok := st.(dgo.String); ok {
@@ -91,6 +120,116 @@ func NewGroup(parent Group, input dgo.Map) Group {
 	return g
 }
 
+// mergeParent merges the local config, facts, features, and vars of this group with the merged values of
+// its parent.
+func (g *group) mergeParent() {
+	var config, facts, vars dgo.Map
+	var features dgo.Array
+	if g.parent == nil {
+		config = vf.Map()
+		facts = vf.Map()
+		features = vf.Values()
+		vars = vf.Map()
+	} else {
+		config = g.parent.Config()
+		facts = g.parent.Facts()
+		features = g.parent.Features()
+		vars = g.parent.Vars()
+	}
+	g.config = DeepMerge(config, g.LocalConfig())
+	g.config.Freeze()
+	g.facts = DeepMerge(facts, g.LocalFacts())
+	g.facts.Freeze()
+	g.features = mergeFeatures(features, g.LocalFeatures())
+	g.features.Freeze()
+	g.vars = mergeVars(vars, g.LocalVars())
+	g.vars.Freeze()
+}
+
+func (g *group) Config() dgo.Map {
+	return g.config
+}
+
+func (g *group) Facts() dgo.Map {
+	return g.facts
+}
+
+func (g *group) Features() dgo.Array {
+	return g.features
+}
+
+func (g *group) Vars() dgo.Map {
+	return g.vars
+}
+
+func (g *group) DataMap() dgo.Map {
+	return g.dataMap
+}
+
+// ID returns the name of the group. The name is unique within the realm.
+func (g *group) ID() string {
+	return g.Name().GoString()
+}
+
+func (g *group) RID(serviceName string) string {
+	return serviceName + `.` + g.realmName().GoString() + `.` + groups + `.` + g.ID()
+}
+
+func (g *group) UpdateFrom(other change.Identifiable, mods []*change.Modification) []*change.Modification {
+	return change.Map(g.realmName().GoString()+`.`+groups+`.`+g.ID(), g.DataMap(), other.(*group).DataMap(), mods)
+}
+
+// initDataMap initializes the map that represents this group as a resource. The map contains the local
+// config, facts, features, and vars of the group together with its child groups and the given member
+// targets.
+func (g *group) initDataMap(members dgo.Array) {
+	m := vf.MutableMap()
+	m.Put(nameV, g.Name())
+	m.Put(realmV, g.realmName())
+	if config := g.LocalConfig(); config.Len() > 0 {
+		m.Put(configV, config.Copy(false))
+	}
+	if facts := g.LocalFacts(); facts.Len() > 0 {
+		m.Put(factsV, facts.Copy(false))
+	}
+	if features := g.LocalFeatures(); features.Len() > 0 {
+		m.Put(featuresV, features.Copy(false))
+	}
+	if vars := g.LocalVars(); vars.Len() > 0 {
+		m.Put(varsV, vars.Copy(false))
+	}
+	m.Put(groupsV, g.LocalGroups().Copy(false))
+	m.Put(targetsV, members)
+	g.dataMap = m
+}
+
+// clone returns a copy of this group with a copy of its data map, in which the child groups and member
+// targets are cloned too, so that the data map can be modified without affecting this group.
+func (g *group) clone() *group {
+	c := *g
+	c.dataMap = g.dataMap.Copy(false)
+	c.dataMap.Put(groupsV, cloneGroups(g.dataMap.Get(groupsV).(dgo.Array)))
+	members := vf.MutableValues()
+	g.dataMap.Get(targetsV).(dgo.Array).Each(func(t dgo.Value) { members.Add(t.(*trg).clone()) })
+	c.dataMap.Put(targetsV, members)
+	return &c
+}
+
+// cloneGroups returns a mutable array with clones of the given groups
+func cloneGroups(gs dgo.Array) dgo.Array {
+	clones := vf.MutableValues()
+	gs.Each(func(g dgo.Value) { clones.Add(g.(*group).clone()) })
+	return clones
+}
+
+// realmName returns the name of the top level group, i.e. the realm
+func (g *group) realmName() dgo.String {
+	if ps := g.AllParents(); len(ps) > 0 {
+		return ps[0].Name()
+	}
+	return g.Name()
+}
+
 func (g *group) Equals(other interface{}) bool {
 	if og, ok := other.(*group); ok {
 		return g.input.Equals(og.input)
@@ -135,6 +274,7 @@ func (g *group) ResolveStringTargets(allAlias, allTargets dgo.Map) {
 }
 
 func (g *group) resolveStringTarget(stringTarget dgo.String, allAlias, allTargets dgo.Map) {
+	ref := stringTarget
 	if alias, ok := allAlias.Get(stringTarget).(dgo.String); ok {
 		stringTarget = alias
 	}
@@ -143,10 +283,10 @@ func (g *group) resolveStringTarget(stringTarget dgo.String, allAlias, allTarget
 		if tgs.Any(func(t dgo.Value) bool { return t.(Data).HasParent(g) }) {
 			logrus.Warnf(`ignoring duplicate target in %s: %s`, g.Name(), stringTarget)
 		} else {
-			tgs.Add(g.targetFromString(stringTarget))
+			tgs.Add(g.targetFromString(stringTarget, ref))
 		}
 	} else {
-		t := g.targetFromString(stringTarget)
+		t := g.targetFromString(stringTarget, ref)
 		if t.URI() != nil {
 			allTargets.Put(stringTarget, vf.MutableValues(t))
 		} else {
@@ -155,14 +295,19 @@ func (g *group) resolveStringTarget(stringTarget dgo.String, allAlias, allTarget
 	}
 }
 
-func (g *group) targetFromString(s dgo.String) Target {
+// targetFromString creates a target from the given name or URI. The ref is the string that was used
+// in the group's targets array. It differs from s when the target was referenced using an alias.
+func (g *group) targetFromString(s, ref dgo.String) *trg {
+	var input dgo.Map
 	if namePattern.Instance(s) {
-		return NewTarget(g, vf.Map(nameV, s))
-	}
-	if _, err := url.Parse(s.GoString()); err != nil {
-		panic(fmt.Errorf(`the string '%s' is not a valid URI: %s`, s, err.Error()))
+		input = vf.Map(nameV, s)
+	} else {
+		if _, err := url.Parse(s.GoString()); err != nil {
+			panic(fmt.Errorf(`the string '%s' is not a valid URI: %s`, s, err.Error()))
+		}
+		input = vf.Map(uriV, s)
 	}
-	return NewTarget(g, vf.Map(uriV, s))
+	return &trg{dta: dta{parent: g, input: input}, ref: ref}
 }
 
 func (g *group) Type() dgo.Type {
@@ -0,0 +1,297 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/vf"
+	dgoyaml "github.com/lyraproj/dgoyaml/yaml"
+	"github.com/puppetlabs/inventory/pkcs7"
+)
+
+// A Plugin resolves `_plugin` references found in inventory files. A reference is a map that contains
+// a `_plugin` key that holds the name of the plugin. The other entries of the map are parameters to the
+// plugin.
+type Plugin interface {
+	// Resolve returns the value that the reference with the given parameters resolves to. The returned
+	// value may in turn contain references.
+	Resolve(rc ResolveContext, params dgo.Map) (dgo.Value, error)
+}
+
+// PluginFunc is an adapter that allows the use of an ordinary function as a Plugin.
+type PluginFunc func(rc ResolveContext, params dgo.Map) (dgo.Value, error)
+
+// Resolve calls f(rc, params)
+func (f PluginFunc) Resolve(rc ResolveContext, params dgo.Map) (dgo.Value, error) {
+	return f(rc, params)
+}
+
+// A ResolveContext is passed to a Plugin when it resolves a reference.
+type ResolveContext interface {
+	// Context returns the context of the operation that caused the reference to be resolved. Plugins that
+	// perform lengthy operations should abort when the context is done.
+	Context() context.Context
+
+	// Dir returns the directory of the inventory file that contains the reference. Relative paths
+	// should be resolved against this directory.
+	Dir() string
+
+	// Depend declares that the resolved value depends on the file at the given path. References in
+	// the inventory file are resolved again when that file changes.
+	Depend(path string)
+}
+
+var pluginV = vf.String(`_plugin`)
+var filepathV = vf.String(`filepath`)
+
+var pluginsLock sync.RWMutex
+var plugins = make(map[string]Plugin)
+
+func init() {
+	RegisterPlugin(`env_var`, PluginFunc(envVarPlugin))
+	RegisterPlugin(`file`, PluginFunc(filePlugin))
+	RegisterPlugin(`yaml`, PluginFunc(yamlPlugin))
+}
+
+// RegisterPlugin registers a Plugin under the given name. Any plugin previously registered under
+// the same name is replaced.
+func RegisterPlugin(name string, p Plugin) {
+	pluginsLock.Lock()
+	plugins[name] = p
+	pluginsLock.Unlock()
+}
+
+func lookupPlugin(name string) Plugin {
+	pluginsLock.RLock()
+	defer pluginsLock.RUnlock()
+	return plugins[name]
+}
+
+type resolver struct {
+	ctx     context.Context
+	dir     string
+	deps    map[string]bool
+	plugins *execPlugins
+	keys    *pkcs7.KeyPair
+}
+
+func (rc *resolver) Context() context.Context {
+	return rc.ctx
+}
+
+func (rc *resolver) Dir() string {
+	return rc.dir
+}
+
+func (rc *resolver) Depend(path string) {
+	rc.deps[path] = true
+}
+
+// dependencies returns the paths of all files that the resolved values depend on
+func (rc *resolver) dependencies() []string {
+	deps := make([]string, 0, len(rc.deps))
+	for path := range rc.deps {
+		deps = append(deps, path)
+	}
+	return deps
+}
+
+// resolveReferences returns a copy of the given inventory data where all plugin references have been
+// resolved. Maps and Arrays that contain no references are retained as is.
+func (rc *resolver) resolveReferences(data dgo.Map) (dgo.Map, error) {
+	v, _, err := rc.resolve(data, false)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := v.(dgo.Map); ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf(`inventory data resolved into a %s`, v.Type())
+}
+
+// resolve resolves all references in the given value and returns the result together with a boolean that
+// is true if the value contained references. When splice is true, elements of arrays that are references
+// that resolve into arrays are replaced by the elements of the resolved array.
+func (rc *resolver) resolve(v dgo.Value, splice bool) (dgo.Value, bool, error) {
+	switch v := v.(type) {
+	case dgo.Map:
+		if pn, ok := v.Get(pluginV).(dgo.String); ok {
+			rv, err := rc.resolvePlugin(pn.GoString(), v)
+			if err != nil {
+				return nil, false, err
+			}
+			rv, _, err = rc.resolve(rv, splice)
+			return rv, true, err
+		}
+		return rc.resolveMap(v)
+	case dgo.Array:
+		return rc.resolveArray(v, splice)
+	case dgo.String:
+		if rc.keys != nil && pkcs7.IsEncrypted(v.GoString()) {
+			dv, err := rc.keys.DecryptString(v.GoString())
+			return dv, true, err
+		}
+	}
+	return v, false, nil
+}
+
+func (rc *resolver) resolveMap(m dgo.Map) (dgo.Value, bool, error) {
+	var c dgo.Map
+	var err error
+	m.EachEntry(func(e dgo.MapEntry) {
+		if err != nil {
+			return
+		}
+		k := e.Key()
+		var ev dgo.Value
+		var changed bool
+		ev, changed, err = rc.resolve(e.Value(), targetsV.Equals(k) || groupsV.Equals(k))
+		if changed {
+			if c == nil {
+				c = m.Copy(false)
+			}
+			c.Put(k, ev)
+		}
+	})
+	if err != nil || c == nil {
+		return m, false, err
+	}
+	c.Freeze()
+	return c, true, nil
+}
+
+func (rc *resolver) resolveArray(a dgo.Array, splice bool) (dgo.Value, bool, error) {
+	var c dgo.Array
+	for i, n := 0, a.Len(); i < n; i++ {
+		e := a.Get(i)
+		ev, changed, err := rc.resolve(e, false)
+		if err != nil {
+			return nil, false, err
+		}
+		if changed && c == nil {
+			c = vf.MutableValues()
+			c.AddAll(a.Slice(0, i))
+		}
+		if c != nil {
+			if ea, ok := ev.(dgo.Array); ok && splice && isReference(e) {
+				c.AddAll(ea)
+			} else {
+				c.Add(ev)
+			}
+		}
+	}
+	if c == nil {
+		return a, false, nil
+	}
+	c.Freeze()
+	return c, true, nil
+}
+
+func (rc *resolver) resolvePlugin(name string, params dgo.Map) (dgo.Value, error) {
+	if err := rc.ctx.Err(); err != nil {
+		return nil, err
+	}
+	var p Plugin
+	if name == pkcs7.PluginName {
+		p = PluginFunc(func(_ ResolveContext, params dgo.Map) (dgo.Value, error) { return rc.keys.DecryptReference(params) })
+	} else if p = lookupPlugin(name); p == nil {
+		if !validPluginName(name) {
+			return nil, fmt.Errorf(`invalid plugin name %q`, name)
+		}
+		p = rc.plugins.lookup(name)
+	}
+	if p == nil {
+		return nil, fmt.Errorf(`unknown plugin %q`, name)
+	}
+	v, err := p.Resolve(rc, params)
+	if err != nil {
+		return nil, fmt.Errorf(`plugin %q: %s`, name, err.Error())
+	}
+	if v == nil {
+		v = vf.Nil
+	}
+	return v, nil
+}
+
+func isReference(v dgo.Value) bool {
+	if m, ok := v.(dgo.Map); ok {
+		return m.ContainsKey(pluginV)
+	}
+	return false
+}
+
+// containsReference returns true if the given value is a reference or contains a reference at any depth
+func containsReference(v dgo.Value) bool {
+	switch v := v.(type) {
+	case dgo.Map:
+		return v.ContainsKey(pluginV) || v.Any(func(e dgo.MapEntry) bool { return containsReference(e.Value()) })
+	case dgo.Array:
+		return v.Any(containsReference)
+	}
+	return false
+}
+
+// pathParam returns the value of the filepath parameter. A relative path is resolved against the
+// directory of the inventory file.
+func pathParam(rc ResolveContext, params dgo.Map) (string, error) {
+	fp, err := stringParam(params, filepathV)
+	if err != nil {
+		return ``, err
+	}
+	path := fp.GoString()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(rc.Dir(), path)
+	}
+	return path, nil
+}
+
+// envVarPlugin resolves to the value of the environment variable appointed by the var parameter, or
+// to the value of the default parameter if the variable isn't set.
+func envVarPlugin(_ ResolveContext, params dgo.Map) (dgo.Value, error) {
+	n, err := stringParam(params, vf.String(`var`))
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv(n.GoString()); ok {
+		return vf.String(v), nil
+	}
+	if dv := params.Get(`default`); dv != nil {
+		return dv, nil
+	}
+	return nil, fmt.Errorf(`environment variable %q is not set`, n)
+}
+
+// filePlugin resolves to the contents of the file appointed by the filepath parameter.
+func filePlugin(rc ResolveContext, params dgo.Map) (dgo.Value, error) {
+	path, err := pathParam(rc, params)
+	if err != nil {
+		return nil, err
+	}
+	rc.Depend(path)
+	/* #nosec */
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return vf.String(string(bs)), nil
+}
+
+// yamlPlugin resolves to the contents of the yaml file appointed by the filepath parameter.
+func yamlPlugin(rc ResolveContext, params dgo.Map) (dgo.Value, error) {
+	path, err := pathParam(rc, params)
+	if err != nil {
+		return nil, err
+	}
+	rc.Depend(path)
+	/* #nosec */
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return dgoyaml.Unmarshal(bs)
+}
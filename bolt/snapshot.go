@@ -0,0 +1,137 @@
+package bolt
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/vf"
+)
+
+// A snapshot is the state of the storage as last published. It is never modified once it has been stored,
+// so readers can use it without holding the lock of the storage while the watch or a change replaces it.
+type snapshot struct {
+	names   []string          // the realm names, alphabetically sorted
+	realms  map[string]*realm // copies of the realms, keyed by name
+	targets dgo.Array         // all merged targets as an array
+	status  dgo.Map           // the frozen status
+	watched bool              // true when the storage is watched and the watch is working
+}
+
+// loadSnapshot returns the last stored snapshot or nil if the storage hasn't been read yet
+func (s *storage) loadSnapshot() *snapshot {
+	snap, _ := s.snap.Load().(*snapshot)
+	return snap
+}
+
+// storeSnapshot stores a snapshot of the current state of the storage. All realms must have been published.
+// The caller must hold the lock of the storage.
+func (s *storage) storeSnapshot() {
+	names := s.realmNames()
+	snap := &snapshot{
+		names:   names,
+		realms:  make(map[string]*realm, len(names)),
+		targets: vf.MutableValues(),
+		status:  s.status.Copy(true),
+		watched: s.watched(),
+	}
+	for _, rn := range names {
+		// The fields of the copy are replaced, never modified, when the realm is read again
+		rc := *s.realmMap[rn]
+		snap.realms[rn] = &rc
+		snap.targets.AddAll(rc.listed)
+	}
+	s.snap.Store(snap)
+}
+
+// storeWatchState stores a snapshot with the current status and watch state of the storage. The caller must
+// hold the lock of the storage.
+func (s *storage) storeWatchState() {
+	prev := s.loadSnapshot()
+	if prev == nil {
+		return
+	}
+	snap := *prev
+	snap.status = s.status.Copy(true)
+	snap.watched = s.watched()
+	s.snap.Store(&snap)
+}
+
+func (snap *snapshot) get(key string) dgo.Value {
+	parts := strings.Split(key, `.`)
+	var result dgo.Value
+	switch p0 := parts[0]; p0 {
+	case target:
+		if len(parts) >= 2 {
+			result = snap.target(parts[1])
+			if result != nil && len(parts) > 2 {
+				if parts[2] == explain {
+					result = snap.explain(parts[1], parts[3:])
+				} else {
+					result = dig(parts[2:], result)
+				}
+			}
+		}
+	case targets:
+		result = snap.targets
+		if len(parts) > 1 {
+			result = dig(parts[1:], result)
+		}
+	case status:
+		result = dig(parts[1:], snap.status)
+	default:
+		if realm, ok := snap.realms[p0]; ok {
+			result = realm.get(parts[1:])
+		}
+	}
+	return result
+}
+
+// target returns the merged target with the given id or nil if no such target exists
+func (snap *snapshot) target(id string) dgo.Value {
+	rn, _, ok := parseID(id)
+	if !ok {
+		return nil
+	}
+	realm, ok := snap.realms[rn]
+	if !ok {
+		return nil
+	}
+	return realm.targets.Get(id)
+}
+
+// explain returns the explanation of how the merged config, facts, and vars of the target with the given id
+// were declared. The given keys are used to dig into the explanation.
+func (snap *snapshot) explain(id string, keys []string) dgo.Value {
+	rn, n, ok := parseID(id)
+	if !ok {
+		return nil
+	}
+	realm, ok := snap.realms[rn]
+	if !ok {
+		return nil
+	}
+	var result dgo.Value = realm.explain(n)
+	if result != nil && len(keys) > 0 {
+		result = dig(keys, result)
+	}
+	return result
+}
+
+func (snap *snapshot) matchingTargets(realmMatch, groupMatch string) dgo.Map {
+	targetNames := vf.MutableMap()
+	var rrx *regexp.Regexp
+	if realmMatch != `` {
+		rrx = regexp.MustCompile(regexp.QuoteMeta(realmMatch))
+	}
+	var grx *regexp.Regexp
+	if groupMatch != `` {
+		grx = regexp.MustCompile(regexp.QuoteMeta(groupMatch))
+	}
+	for _, rn := range snap.names {
+		if rrx == nil || rrx.FindString(rn) != `` {
+			snap.realms[rn].matchingTargets(grx, targetNames)
+		}
+	}
+	return targetNames
+}
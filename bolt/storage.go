@@ -2,10 +2,12 @@
 package bolt
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -13,26 +15,28 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/lyraproj/dgo/dgo"
 	"github.com/lyraproj/dgo/tf"
 	"github.com/lyraproj/dgo/typ"
 	"github.com/lyraproj/dgo/vf"
 	"github.com/puppetlabs/inventory/change"
 	"github.com/puppetlabs/inventory/iapi"
+	"github.com/puppetlabs/inventory/pkcs7"
 	"github.com/puppetlabs/inventory/query"
 	"github.com/puppetlabs/inventory/yaml"
 	"github.com/sirupsen/logrus"
 )
 
-// Storage is an extension of the iapi.Storage interface that adds the ability to add a
-// Watcher to that detects changes to the underlying files.
+// Storage is an iapi.Callable that is also an iapi.Watchable, i.e. it detects changes made to the
+// underlying files.
 type Storage interface {
-	iapi.Storage
+	iapi.Callable
 
-	Watch(func([]*change.Modification)) *fsnotify.Watcher
+	// Watch is the iapi.Watchable method
+	Watch(ctx context.Context, onModify func([]*change.Modification)) (io.Closer, error)
 }
 
 var inventoryFileType dgo.Type
@@ -83,98 +87,123 @@ func init() {
 }
 
 const minRefresh = time.Second * 1
+const addGroup = `addGroup`
+const addTarget = `addTarget`
+const moveTarget = `moveTarget`
+const removeGroup = `removeGroup`
+const groups = `groups`
+const status = `status`
 const target = `target`
 const targets = `targets`
 
 var realmV = vf.String(`realm`)
 
 type storage struct {
-	lock       sync.Mutex
-	path       string            // Path to directory containing inventory files
-	age        time.Time         // Time when directory was checked for new realms
-	realmMap   map[string]*realm // the realms. One per inventory file
-	targets    dgo.Array         // all merged targets as an array
-	targetByID dgo.Map           // all merged, keyed by id
+	lock     sync.Mutex
+	snap     atomic.Value      // the *snapshot that readers use
+	path     string            // Path to directory containing inventory files
+	age      time.Time         // Time when directory was checked for new realms
+	realmMap map[string]*realm // the realms. One per inventory file
+	removed  []*realm          // removed realms whose removal hasn't been published yet
+	status   dgo.Map           // the status, as last published
+	plugins  *execPlugins      // external plugins
+	keys     *pkcs7.KeyPair    // keys used when decrypting values
+	watches  int               // number of active watches
+	scanDir  bool              // true when a watch has detected changes that might add or remove realms
+	watchErr error             // error that prevents the storage from being watched
 }
 
 type realm struct {
-	path            string    // Path to inventory file
-	age             time.Time // Time when file was read from disk
-	contents        Group     // the realm group
-	targets         dgo.Map   // merged targets, keyed by id
-	targetsByName   dgo.Map   // merged targets, keyed by name
-	unmergedTargets dgo.Map   // targets prior to merge. Map of name <=> array of targets
-	aliases         dgo.Map   // map of alias <=> target name
-	input           dgo.Map
+	name            string         // name of the realm
+	path            string         // Path to inventory file
+	plugins         *execPlugins   // external plugins
+	keys            *pkcs7.KeyPair // keys used when decrypting values
+	err             error          // error from last attempt to read the inventory file
+	age             time.Time      // Time when file was read from disk
+	contents        Group          // the realm group
+	targets         dgo.Map        // merged targets, keyed by id
+	targetsByName   dgo.Map        // merged targets, keyed by name
+	unmergedTargets dgo.Map        // targets prior to merge. Map of name <=> array of targets
+	aliases         dgo.Map        // map of alias <=> target name
+	groups          dgo.Map        // all groups except the realm itself, keyed by name
+	listed          dgo.Array      // merged targets, as last published in the realm's targets list
+	listedGroups    dgo.Array      // top level groups, as last published in the realm's groups list
+	data            dgo.Map        // contents of the inventory file
+	deps            []string       // files that resolved plugin references depend on
+	stale           bool           // true when the watch has detected a change of the file or its dependencies
+	changed         bool           // true when the contents have been read but the modifications are unpublished
+	input           dgo.Map        // contents of the inventory file with resolved plugin references
 }
 
-// NewStorage creates a new storage for the bolt inventory version 2 file at the given path
-func NewStorage(path string) Storage {
-	return &storage{path: path}
+// An Option configures a Storage
+type Option func(*storage)
+
+// Keys sets the key pair used when decrypting ENC[PKCS7,...] strings and pkcs7 plugin references. The decrypted
+// values are sensitive.
+func Keys(keys *pkcs7.KeyPair) Option {
+	return func(s *storage) {
+		s.keys = keys
+	}
 }
 
-func (s *storage) Delete(_ string) ([]*change.Modification, bool) {
-	panic("implement me")
+// NewStorage creates a new storage for the bolt inventory version 2 files in the directory at the given path
+func NewStorage(path string, options ...Option) Storage {
+	s := &storage{path: path, plugins: newExecPlugins()}
+	for _, option := range options {
+		option(s)
+	}
+	return s
 }
 
-func (s *storage) Get(key string) ([]*change.Modification, dgo.Value) {
-	mods := s.refresh()
+func (s *storage) Delete(ctx context.Context, key string) (mods []*change.Modification, err error) {
+	defer recoverError(&err)
+	mods = s.refresh(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	parts := strings.Split(key, `.`)
-	if len(parts) == 0 {
-		return mods, nil
-	}
-	var result dgo.Value
-	p0 := parts[0]
-	switch p0 {
-	case target:
-		if len(parts) >= 2 {
-			result = s.targetByID.Get(parts[1])
-			if result != nil && len(parts) > 2 {
-				result = dig(parts[2:], result)
-			}
-		}
-	case targets:
-		result = s.targets
-		if len(parts) > 1 {
-			result = dig(parts[1:], result)
-		}
-	default:
-		if realm, ok := s.realmMap[p0]; ok {
-			result = realm.get(parts[1:])
+	deleted := false
+	if len(parts) == 3 && parts[1] == groups {
+		if realm, ok := s.realmMap[parts[0]]; ok {
+			deleted, err = realm.deleteGroup(ctx, parts[2])
 		}
+	} else if realm, name, path := s.locateTarget(parts); realm != nil && len(path) == 0 {
+		deleted, err = realm.deleteTarget(ctx, name)
+	}
+	if err != nil {
+		return mods, err
 	}
-	return mods, result
+	if !deleted {
+		return mods, iapi.NotFound(key)
+	}
+	return append(mods, s.readRealms(ctx)...), nil
 }
 
-func (s *storage) matchingTargets(realmMatch, groupMatch string) dgo.Map {
-	targetNames := vf.MutableMap()
-	var rs []*realm
-	if realmMatch == `` {
-		rs = s.realms()
-	} else {
-		rrx := regexp.MustCompile(regexp.QuoteMeta(realmMatch))
-		for _, rn := range s.realmNames() {
-			if rrx.FindString(rn) != `` {
-				rs = append(rs, s.realmMap[rn])
-			}
-		}
-	}
+func (s *storage) Get(ctx context.Context, key string) (mods []*change.Modification, result dgo.Value, err error) {
+	defer recoverError(&err)
+	var snap *snapshot
+	mods, snap = s.read(ctx)
+	return mods, snap.get(key), nil
+}
 
-	var grx *regexp.Regexp
-	if groupMatch != `` {
-		grx = regexp.MustCompile(regexp.QuoteMeta(groupMatch))
-	}
-	for _, r := range rs {
-		r.matchingTargets(grx, targetNames)
+// read returns the modifications that a refresh of the storage results in together with the snapshot that
+// the refreshed storage is read from. A storage that is watched isn't refreshed since the watch publishes
+// the changes, so reading it never waits for a change to complete.
+func (s *storage) read(ctx context.Context) ([]*change.Modification, *snapshot) {
+	if snap := s.loadSnapshot(); snap != nil && snap.watched {
+		return nil, snap
 	}
-	return targetNames
+	mods := s.refresh(ctx)
+	return mods, s.loadSnapshot()
 }
 
-func (s *storage) Query(key string, q dgo.Map) ([]*change.Modification, query.Result) {
-	mods, v := s.Get(key)
-	a, ok := v.(dgo.Array)
+func (s *storage) Query(ctx context.Context, key string, q dgo.Map) (mods []*change.Modification, result query.Result, err error) {
+	defer recoverError(&err)
+	var snap *snapshot
+	mods, snap = s.read(ctx)
+	a, ok := snap.get(key).(dgo.Array)
 	if !ok || a.Len() == 0 {
-		return mods, nil
+		return mods, nil, nil
 	}
 
 	stringParam := func(parameterName string) string {
@@ -184,9 +213,9 @@ func (s *storage) Query(key string, q dgo.Map) ([]*change.Modification, query.Re
 		return ``
 	}
 
-	targetNames := s.matchingTargets(stringParam(`realm`), stringParam(`group`))
+	targetNames := snap.matchingTargets(stringParam(`realm`), stringParam(`group`))
 	if targetNames.Len() == 0 {
-		return mods, nil
+		return mods, nil, nil
 	}
 
 	targetMatch := stringParam(`target`)
@@ -201,10 +230,15 @@ func (s *storage) Query(key string, q dgo.Map) ([]*change.Modification, query.Re
 			}
 		})
 		if targetNames.Len() == 0 {
-			return mods, nil
+			return mods, nil, nil
 		}
 	}
 
+	var memberOf dgo.Value
+	if mo := stringParam(`memberOf`); mo != `` {
+		memberOf = vf.String(mo)
+	}
+
 	qr := query.NewResult(false)
 	a.EachWithIndex(func(v dgo.Value, i int) {
 		m := v.(Target)
@@ -215,9 +249,17 @@ func (s *storage) Query(key string, q dgo.Map) ([]*change.Modification, query.Re
 		if !targetNames.ContainsKey(n) {
 			return
 		}
+		if memberOf != nil {
+			if gs, ok := m.DataMap().Get(groupsV).(dgo.Array); !ok || gs.IndexOf(memberOf) < 0 {
+				return
+			}
+		}
 		qr.Add(vf.Integer(int64(i)), m)
 	})
-	return mods, qr
+	if qr.Len() == 0 {
+		return mods, nil, nil
+	}
+	return mods, qr, nil
 }
 
 func (s *storage) QueryKeys(key string) []query.Param {
@@ -227,69 +269,33 @@ func (s *storage) QueryKeys(key string) []query.Param {
 		return []query.Param{
 			query.NewParam(`target`, typ.String, false),
 			query.NewParam(`group`, typ.String, false),
+			query.NewParam(`memberOf`, typ.String, false),
 			query.NewParam(`realm`, typ.String, false),
 		}
 	case len(parts) == 2 && parts[1] == targets: // prefixed with realm
 		return []query.Param{
 			query.NewParam(`target`, typ.String, false),
 			query.NewParam(`group`, typ.String, false),
+			query.NewParam(`memberOf`, typ.String, false),
 		}
 	default:
 		return nil
 	}
 }
 
-func (s *storage) watchFunc(watcher *fsnotify.Watcher, onModify func([]*change.Modification)) {
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			switch {
-			case !ok:
-				return
-			case event.Op&(fsnotify.Write) != 0:
-				if strings.HasSuffix(event.Name, `.yaml`) {
-					mods := s.refreshRealms()
-					if len(mods) > 0 {
-						onModify(mods)
-					}
-				}
-			case event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0:
-				mods := s.refresh()
-				if len(mods) > 0 {
-					onModify(mods)
-				}
-			}
-
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			logrus.Error("error:", err)
-		}
-	}
-}
-
-func (s *storage) Watch(onModify func([]*change.Modification)) *fsnotify.Watcher {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		panic(err)
-	}
-	go s.watchFunc(watcher, onModify)
-
-	err = watcher.Add(s.path)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return watcher
-}
-
-func (s *storage) refresh() []*change.Modification {
+// refresh detects added and removed inventory files and refreshes all realms. It panics with the error of
+// the given context if the context is done before the refresh completes. The directory is only read when
+// the storage isn't watched or when the watch has detected a change in it.
+func (s *storage) refresh(ctx context.Context) []*change.Modification {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	if s.realmMap != nil && s.watched() && !s.scanDir {
+		return s.readRealms(ctx)
+	}
 	fis, err := ioutil.ReadDir(s.path)
 	if err != nil {
-		panic(err)
+		panic(iapi.IOError{Path: s.path, Err: err})
 	}
 
 	initial := s.realmMap == nil
@@ -298,7 +304,6 @@ func (s *storage) refresh() []*change.Modification {
 	}
 
 	fiNames := make(map[string]bool, len(fis))
-	changed := false
 	for _, fi := range fis {
 		if fi.IsDir() {
 			continue
@@ -316,21 +321,25 @@ func (s *storage) refresh() []*change.Modification {
 		fiNames[rn] = true
 		if _, ok := s.realmMap[rn]; !ok {
 			rp := filepath.Join(s.path, fi.Name())
-			s.realmMap[rn] = &realm{path: rp}
+			r := &realm{name: rn, path: rp, plugins: s.plugins, keys: s.keys}
+			if !initial {
+				// Nothing has been published for the new realm
+				r.listed = vf.MutableValues()
+				r.listedGroups = vf.MutableValues()
+			}
+			s.realmMap[rn] = r
 			logrus.Debugf("added file %s as realm %s", rp, rn)
-			changed = true
 		}
 	}
 
 	for _, rn := range s.realmNames() {
 		if !fiNames[rn] {
-			logrus.Debugf("removed realm %s", rn)
-			delete(s.realmMap, rn)
-			changed = true
+			s.removeRealm(rn)
 		}
 	}
+	s.scanDir = false
 
-	mods := s.readRealms(changed)
+	mods := s.readRealms(ctx)
 	if initial {
 		logrus.Debugf("dir %s initialized at: %s", s.path, s.age)
 		mods = nil
@@ -338,36 +347,158 @@ func (s *storage) refresh() []*change.Modification {
 	return mods
 }
 
-func (s *storage) refreshRealms() []*change.Modification {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	return s.readRealms(false)
-}
-
-func (s *storage) readRealms(changed bool) []*change.Modification {
-	all := vf.MutableMap()
+// readRealms refreshes all realms and returns the resulting modifications. It panics with the error of the
+// given context if the context is done before all realms are refreshed. The modifications of the realms that
+// were refreshed up to that point are then returned by the next call.
+func (s *storage) readRealms(ctx context.Context) []*change.Modification {
+	watched := s.watched()
 	for _, realmName := range s.realmNames() {
 		realm := s.realmMap[realmName]
-		if realm.refresh() {
+		if err := realm.refresh(ctx, watched); err != nil {
+			panic(err)
+		}
+		if realm.targets == nil {
+			s.removeRealm(realmName)
+		}
+	}
+
+	mods := s.statusModifications(nil)
+	if s.loadSnapshot() == nil {
+		for _, realm := range s.realms() {
+			realm.changed = false
+		}
+		s.removed = nil
+		s.storeSnapshot()
+		return nil
+	}
+	mods = s.publish(mods)
+	if len(mods) > 0 {
+		s.storeSnapshot()
+	}
+	return mods
+}
+
+// removeRealm removes the realm with the given name. The removal is published by the next call to publish.
+func (s *storage) removeRealm(rn string) {
+	logrus.Debugf("removed realm %s", rn)
+	s.removed = append(s.removed, s.realmMap[rn])
+	delete(s.realmMap, rn)
+}
+
+// publish appends the modifications of the realms that have been read or removed since they were last
+// published. Each realm has its own slice of the targets list, so only the slices of those realms are
+// compared.
+func (s *storage) publish(mods []*change.Modification) []*change.Modification {
+	type entry struct {
+		realm   *realm
+		removed bool
+	}
+	es := make([]entry, 0, len(s.removed)+len(s.realmMap))
+	for _, r := range s.removed {
+		es = append(es, entry{r, true})
+	}
+	for _, r := range s.realms() {
+		es = append(es, entry{r, false})
+	}
+	// A removed realm precedes a new realm with the same name
+	sort.SliceStable(es, func(i, j int) bool { return es[i].realm.name < es[j].realm.name })
+	s.removed = nil
+
+	changed := false
+	offset := 0
+	for _, e := range es {
+		r := e.realm
+		switch {
+		case e.removed:
 			changed = true
-			if realm.targets == nil {
-				logrus.Debugf("removed realm %s", realmName)
-				delete(s.realmMap, realmName)
+			if r.listed == nil {
+				// Removed before it was ever read
 				continue
 			}
+			for ix := r.listed.Len() - 1; ix >= 0; ix-- {
+				mods = append(mods, &change.Modification{ResourceName: targets, Index: offset + ix, Type: change.Remove})
+			}
+			r.listed.Each(func(t dgo.Value) {
+				mods = append(mods, &change.Modification{ResourceName: target + `.` + t.(Target).ID(), Type: change.Delete})
+			})
+			continue
+		case r.changed:
+			changed = true
+			mods = s.publishRealm(r, offset, mods)
 		}
-		all.PutAll(realm.targets.Copy(false))
+		offset += r.listed.Len()
 	}
+	if changed {
+		mods = explainResets(mods)
+	}
+	return mods
+}
 
-	s.targetByID = all
-	if s.targets == nil {
-		s.targets = all.Values()
-		return nil
+// publishRealm appends the modifications needed to bring the last published targets and groups of the given
+// realm up to date. The offset is the index in the targets list of the first target of the realm.
+//
+// Computing the modifications modifies the old values, so copies of the last published targets and groups are
+// used. The published values might still be in use by readers of an older snapshot.
+func (s *storage) publishRealm(r *realm, offset int, mods []*change.Modification) []*change.Modification {
+	oldIDs := make([]string, 0, r.listed.Len())
+	listed := vf.MutableValues()
+	r.listed.Each(func(t dgo.Value) {
+		oldIDs = append(oldIDs, t.(Target).ID())
+		listed.Add(t.(*trg).clone())
+	})
+
+	// The realm's targets list is modified in the same way as the realm's slice of the targets list
+	tn := r.name + `.` + targets
+	var listMods []*change.Modification
+	for _, mod := range change.Array(targets, listed, r.targets.Values(), nil) {
+		if mod.ResourceName == targets {
+			lm := *mod
+			lm.ResourceName = tn
+			listMods = append(listMods, &lm)
+			mod.Index += offset
+		}
+		mods = append(mods, mod)
 	}
-	if changed {
-		return change.Array(`targets`, s.targets, all.Values(), nil)
+	mods = r.groupModifications(append(mods, listMods...))
+	for _, id := range oldIDs {
+		if !r.targets.ContainsKey(id) {
+			mods = append(mods, &change.Modification{ResourceName: target + `.` + id, Type: change.Delete})
+		}
 	}
-	return nil
+	r.listed = r.targets.Values()
+	r.changed = false
+	return mods
+}
+
+// statusMap returns a map with the errors that prevented realms from being read, keyed by realm name, and
+// the error that prevents the storage from being watched.
+func (s *storage) statusMap() dgo.Map {
+	errs := vf.MutableMap()
+	for _, rn := range s.realmNames() {
+		if err := s.realmMap[rn].err; err != nil {
+			errs.Put(rn, err.Error())
+		}
+	}
+	st := vf.MutableMap(errorsV, errs)
+	if s.watchErr != nil {
+		st.Put(watchV, s.watchErr.Error())
+	}
+	return st
+}
+
+// watched returns true when the storage is watched and the watch is working
+func (s *storage) watched() bool {
+	return s.watches > 0 && s.watchErr == nil
+}
+
+// statusModifications appends the modifications of the status resource since it was last published
+func (s *storage) statusModifications(mods []*change.Modification) []*change.Modification {
+	st := s.statusMap()
+	if s.status == nil {
+		s.status = st
+		return mods
+	}
+	return change.Map(status, s.status, st, mods)
 }
 
 // realmNames returns all realm names alphabetically sorted
@@ -392,40 +523,139 @@ func (s *storage) realms() []*realm {
 	return rs
 }
 
-func (s *storage) Set(key string, model dgo.Map) (mods []*change.Modification, err error) {
-	defer func() {
-		if pe := recover(); pe != nil {
-			var ok bool
-			if err, ok = pe.(error); ok {
-				return
-			}
-			var es string
-			if es, ok = pe.(string); ok {
-				err = errors.New(es)
-				return
+// RealmOf returns the name of the realm that the resource appointed by the given key belongs to, or an empty
+// string if the resource doesn't belong to a specific realm.
+func (s *storage) RealmOf(key string) string {
+	parts := strings.Split(key, `.`)
+	switch parts[0] {
+	case target:
+		if len(parts) > 1 {
+			if rn, _, ok := parseID(parts[1]); ok {
+				return rn
 			}
-			panic(pe)
 		}
-	}()
-	mods, v := s.Get(key)
-	if v != nil {
-		if t, ok := v.(dgo.Map); ok {
-			if id, ok := t.Get(idV).(dgo.String); ok {
-				rn, n := splitID(id.GoString())
-				if realm, ok := s.realmMap[rn]; ok {
-					return realm.applyChange(n, model)
-				}
+	case targets, status:
+	default:
+		return parts[0]
+	}
+	return ``
+}
+
+// EntitySegments returns the number of leading segments of the given key that appoint a target, a group, a
+// realm, or a listing of such entities. The status resource contains no data so all its segments are counted.
+func (s *storage) EntitySegments(key string) int {
+	parts := strings.Split(key, `.`)
+	n := 1
+	switch parts[0] {
+	case target, targets:
+		n = 2
+	case status:
+		n = len(parts)
+	default:
+		if len(parts) > 1 {
+			switch parts[1] {
+			case groups, targets:
+				n = 3
+			default:
+				n = 2
 			}
 		}
 	}
-	return mods, iapi.NotFound(key)
+	if n > len(parts) {
+		n = len(parts)
+	}
+	return n
+}
+
+// Methods returns the names of the methods that can be called on group resources
+func (s *storage) Methods() []string {
+	return []string{addGroup, addTarget, moveTarget, removeGroup}
+}
+
+// Call performs a method on a group resource. The key must be on the form <realm>.groups.<name> or, to
+// use the realm itself as the group, <realm>.groups.
+func (s *storage) Call(ctx context.Context, key, method string, params dgo.Map) (mods []*change.Modification, result dgo.Value, err error) {
+	defer recoverError(&err)
+	mods = s.refresh(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	parts := strings.Split(key, `.`)
+	var realm *realm
+	groupName := ``
+	if (len(parts) == 2 || len(parts) == 3) && parts[1] == groups {
+		realm = s.realmMap[parts[0]]
+		if len(parts) == 3 {
+			groupName = parts[2]
+		}
+	}
+	if realm == nil {
+		return mods, nil, iapi.NotFound(key)
+	}
+	switch method {
+	case addGroup:
+		err = realm.addGroup(ctx, groupName, params)
+	case addTarget:
+		err = realm.addTarget(ctx, groupName, params)
+	case moveTarget:
+		err = realm.moveTarget(ctx, groupName, params)
+	case removeGroup:
+		err = realm.removeGroup(ctx, groupName, params)
+	default:
+		err = fmt.Errorf(`unknown method %q`, method)
+	}
+	if err != nil {
+		return mods, nil, err
+	}
+	return append(mods, s.readRealms(ctx)...), nil, nil
 }
 
-func (r *realm) applyChange(targetID string, model dgo.Map) (mods []*change.Modification, err error) {
-	// if targets, ok := r.unmergedTargets.Get(targetId).(dgo.Array); ok {
-	//
-	// }
-	return nil, iapi.NotFound(targetID)
+func (s *storage) Set(ctx context.Context, key string, model dgo.Map) (mods []*change.Modification, err error) {
+	defer recoverError(&err)
+	mods = s.refresh(ctx)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	realm, name, path := s.locateTarget(strings.Split(key, `.`))
+	if realm == nil {
+		return mods, iapi.NotFound(key)
+	}
+	if err = realm.applyChange(ctx, name, path, model); err != nil {
+		return mods, err
+	}
+	return append(mods, s.readRealms(ctx)...), nil
+}
+
+// locateTarget returns the realm, the unmerged name, and the remaining key path of the target appointed
+// by the given key. The key can either be on the form target.<id> or <realm>.<target name>, or
+// <realm>.targets.<index>. A nil realm is returned when no target can be found.
+func (s *storage) locateTarget(parts []string) (*realm, string, []string) {
+	if len(parts) < 2 {
+		return nil, ``, nil
+	}
+	var t Target
+	if parts[0] == target {
+		rn, _, _ := parseID(parts[1])
+		if realm, ok := s.realmMap[rn]; ok {
+			t, _ = realm.targets.Get(parts[1]).(Target)
+		}
+		parts = parts[2:]
+	} else if realm, ok := s.realmMap[parts[0]]; ok {
+		if parts[1] == targets {
+			if len(parts) > 2 {
+				t, _ = dig(parts[2:3], realm.targets.Values()).(Target)
+				parts = parts[3:]
+			}
+		} else {
+			t, _ = realm.targetsByName.Get(parts[1]).(Target)
+			parts = parts[2:]
+		}
+	}
+	if t == nil {
+		return nil, ``, nil
+	}
+	rn, n := splitID(t.ID())
+	return s.realmMap[rn], n, parts
 }
 
 func (r *realm) get(parts []string) dgo.Value {
@@ -433,10 +663,17 @@ func (r *realm) get(parts []string) dgo.Value {
 		return nil
 	}
 	var top dgo.Value
-	if parts[0] == targets {
+	switch parts[0] {
+	case groups:
+		parts = parts[1:]
+		if len(parts) == 0 {
+			return r.contents.LocalGroups()
+		}
+		top = r.groups
+	case targets:
 		parts = parts[1:]
 		top = r.targets.Values()
-	} else {
+	default:
 		top = r.targetsByName
 	}
 	value := dig(parts, top)
@@ -463,55 +700,116 @@ func (r *realm) matchingTargets(groupNamePattern *regexp.Regexp, targetNames dgo
 	})
 }
 
-// refreshContents read the inventory yaml file on disk if the cache is deemed to be out of date. The
-// cache is considered up to date if the last known state of the file is less than the value of the
-// const minRefresh, or if a new stat call shows that the file hasn't been updated.
-func (r *realm) refresh() bool {
+// refresh reads the inventory yaml file on disk if the cache is deemed to be out of date. A stale realm
+// is always out of date. Otherwise, the cache is considered up to date if the realm is watched, if the last
+// known state of the file is less than the value of the const minRefresh, or if a new stat call shows that
+// the file hasn't been updated.
+func (r *realm) refresh(ctx context.Context, watched bool) error {
 	now := time.Now()
-	if r.contents == nil {
-		r.age = now
-		r.readInventory()
-		return true
+	if r.contents == nil || r.stale {
+		return r.reload(ctx, now)
 	}
 
-	if now.Sub(r.age) < minRefresh {
-		return false
+	if watched || now.Sub(r.age) < minRefresh {
+		return nil
 	}
 
 	cs, err := os.Stat(r.path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			r.targets = nil // Gone
-			return true
+			return nil
 		}
-		panic(err)
+		return iapi.IOError{Path: r.path, Err: err}
 	}
 
 	if cs.ModTime().After(r.age) {
 		logrus.Debugf("file %s modified at: %s, last refresh at: %s", r.path, cs.ModTime(), r.age)
-		r.age = now
-		r.readInventory()
-		return true
+		return r.reload(ctx, now)
+	}
+	for _, dep := range r.deps {
+		if ds, err := os.Stat(dep); err != nil || ds.ModTime().After(r.age) {
+			logrus.Debugf("dependency %s of file %s modified, last refresh at: %s", dep, r.path, r.age)
+			return r.reload(ctx, now)
+		}
 	}
 	r.age = now
-	return false
+	return nil
 }
 
-func (r *realm) readInventory() {
-	defer func() {
-		if e := recover(); e != nil {
-			logrus.Errorf(`unable to read inventory from %v: %s`, e, r.path)
+// reload reads the inventory file and sets the age of the realm to the given time. The realm retains its
+// contents and age when the given context is done before the file has been read, so that the next refresh
+// reads it again.
+func (r *realm) reload(ctx context.Context, now time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := r.readInventory(ctx); err != nil {
+		return err
+	}
+	r.age = now
+	r.stale = false
+	r.changed = true
+	return nil
+}
+
+// read reads the inventory file and resolves its plugin references
+func (r *realm) read(ctx context.Context) (data, input dgo.Map, deps []string, err error) {
+	defer recoverError(&err)
+	if data, err = yaml.Read(r.path); err != nil {
+		return
+	}
+	input, deps, err = r.resolve(ctx, data)
+	return
+}
+
+// resolve resolves the plugin references of the given inventory data and validates the result. It returns
+// the resolved data and the paths of the files that the resolved data depends on.
+func (r *realm) resolve(ctx context.Context, data dgo.Map) (dgo.Map, []string, error) {
+	rc := &resolver{ctx: ctx, dir: filepath.Dir(r.path), deps: make(map[string]bool), plugins: r.plugins, keys: r.keys}
+	input, err := rc.resolveReferences(data)
+	if err != nil {
+		return nil, rc.dependencies(), err
+	}
+	if !inventoryFileType.Instance(input) {
+		return nil, nil, tf.IllegalAssignment(inventoryFileType, input).(error)
+	}
+	return input, rc.dependencies(), nil
+}
+
+// dependsOn returns true if the given path is the path of a file that resolved plugin references in
+// this realm depend on.
+func (r *realm) dependsOn(path string) bool {
+	for _, dep := range r.deps {
+		if dep == path {
+			return true
 		}
-	}()
+	}
+	return false
+}
 
-	data := yaml.Read(r.path)
-	if !inventoryFileType.Instance(data) {
-		panic(tf.IllegalAssignment(inventoryFileType, data))
+// readInventory reads the inventory file and updates the contents of the realm. The error of the given context
+// is returned, and the contents are left untouched, when the context is done before the file has been read.
+func (r *realm) readInventory(ctx context.Context) error {
+	data, input, deps, err := r.read(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	r.err = err
+	r.deps = deps
+	if err != nil {
+		if r.contents != nil {
+			// Retain what was successfully read the last time
+			return nil
+		}
+		data = vf.Map(`version`, 2)
+		input = data
 	}
 
 	fn := filepath.Base(r.path)
 	ext := filepath.Ext(fn)
-	r.input = data.With(nameV, fn[:len(fn)-len(ext)])
+	r.data = data
+	r.input = input.With(nameV, fn[:len(fn)-len(ext)])
 	all := NewGroup(nil, r.input)
 	ats := vf.MutableMap()
 	als := vf.MutableMap()
@@ -526,30 +824,118 @@ func (r *realm) readInventory() {
 
 	tgm := vf.MutableMap()
 	tgn := vf.MutableMap()
+	members := make(map[Group]dgo.Array)
 	ats.EachEntry(func(e dgo.MapEntry) {
-		merged := r.mergeTargets(e.Value().(dgo.Array))
+		decls := e.Value().(dgo.Array)
+		merged := r.mergeTargets(decls)
 		tgm.Put(merged.ID(), merged)
 		if name := merged.Name(); name != nil {
 			tgn.Put(name, merged)
 		}
+		decls.Each(func(d dgo.Value) {
+			p := d.(*trg).parent
+			if ms, ok := members[p]; !ok {
+				members[p] = vf.MutableValues(merged)
+			} else if ms.IndexOf(merged) < 0 {
+				ms.Add(merged)
+			}
+		})
 	})
 	tgm.Freeze()
 	tgn.Freeze()
 	r.targets = tgm
 	r.targetsByName = tgn
+
+	gm := vf.MutableMap()
+	all.FindGroups(nil).Each(func(gv dgo.Value) {
+		g := gv.(*group)
+		if g == all {
+			return
+		}
+		ms, ok := members[g]
+		if !ok {
+			ms = vf.MutableValues()
+		}
+		g.initDataMap(ms)
+		gm.Put(g.Name(), g)
+	})
+	gm.Freeze()
+	r.groups = gm
+
+	if r.listed == nil {
+		r.listed = tgm.Values().Copy(false)
+		r.listedGroups = all.LocalGroups().Copy(false)
+	}
+	return nil
+}
+
+// groupModifications appends the modifications needed to bring the last published list of groups in this
+// realm up to date with its current groups to the given slice and returns the result.
+func (r *realm) groupModifications(mods []*change.Modification) []*change.Modification {
+	rn := r.name
+
+	oldGroups := vf.MutableMap()
+	collectGroups(r.listedGroups, oldGroups)
+	gn := rn + `.` + groups
+	for _, mod := range change.Array(gn, cloneGroups(r.listedGroups), r.contents.LocalGroups(), nil) {
+		if mod.ResourceName == gn || strings.HasPrefix(mod.ResourceName, gn+`.`) {
+			mods = append(mods, mod)
+		}
+	}
+	oldGroups.EachKey(func(k dgo.Value) {
+		if !r.groups.ContainsKey(k) {
+			mods = append(mods, &change.Modification{ResourceName: gn + `.` + k.String(), Type: change.Delete})
+		}
+	})
+	r.listedGroups = r.contents.LocalGroups()
+	return mods
+}
+
+// collectGroups collects the given groups and the groups beneath them into the given map, keyed by name.
+func collectGroups(gs dgo.Array, all dgo.Map) {
+	gs.Each(func(gv dgo.Value) {
+		g := gv.(Group)
+		all.Put(g.Name(), g)
+		collectGroups(g.DataMap().Get(groupsV).(dgo.Array), all)
+	})
+}
+
+// recoverError recovers a panic and assigns it to the given error pointer if the panic value is an
+// error or a string. Other panics are propagated.
+func recoverError(err *error) {
+	if pe := recover(); pe != nil {
+		switch pe := pe.(type) {
+		case error:
+			*err = pe
+		case string:
+			*err = errors.New(pe)
+		default:
+			panic(pe)
+		}
+	}
 }
 
 func splitID(id string) (string, string) {
+	rn, n, ok := parseID(id)
+	if !ok {
+		panic(errors.New(`invalid ID`))
+	}
+	return rn, n
+}
+
+// parseID splits the given ID into a realm name and a target name. The boolean is false if
+// the ID isn't valid.
+func parseID(id string) (string, string, bool) {
 	v, err := base64.URLEncoding.DecodeString(id)
 	if err != nil {
-		panic(err)
+		return ``, ``, false
 	}
 	vs := string(v)
 	di := strings.IndexByte(vs, '.')
 	if di < 1 {
-		panic(errors.New(`invalid ID`))
+		return ``, ``, false
 	}
-	return vs[:di], vs[di+1:]
+	return vs[:di], vs[di+1:], true
 }
 
 // dig will into the given value which must be a Map or an Array using the given keys in the given slice.
@@ -564,8 +950,8 @@ func dig(keys []string, v dgo.Value) dgo.Value {
 					continue
 				}
 			}
-		case Target:
-			v = c.Input().Get(key)
+		case iapi.Resource:
+			v = c.DataMap().Get(key)
 			continue
 		case dgo.Map:
 			v = c.Get(key)
@@ -1,10 +1,21 @@
 package bolt_test
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/puppetlabs/inventory/change"
 	"github.com/puppetlabs/inventory/iapi"
+	"github.com/puppetlabs/inventory/pkcs7"
 
 	"github.com/lyraproj/dgo/dgo"
 	"github.com/puppetlabs/inventory/query"
@@ -14,15 +25,17 @@ import (
 	"github.com/puppetlabs/inventory/bolt"
 )
 
+var ctx = context.Background()
+
 func TestGet_deep(t *testing.T) {
 	b := bolt.NewStorage(staticDir())
-	_, v := b.Get(`realm_a.mc1.config.transport`)
+	_, v, _ := b.Get(ctx, `realm_a.mc1.config.transport`)
 	require.Equal(t, v, `ssh`)
 }
 
 func TestQuery_group(t *testing.T) {
 	b := bolt.NewStorage(staticDir())
-	_, qr := b.Query(`targets`, vf.Map(`group`, `memcached`))
+	_, qr, _ := b.Query(ctx, `targets`, vf.Map(`group`, `memcached`))
 	require.Equal(t,
 		vf.Values(
 			vf.Map(
@@ -30,37 +43,119 @@ func TestQuery_group(t *testing.T) {
 				`name`, `mc1`,
 				`realm`, `realm_a`,
 				`uri`, `192.168.101.50`,
-				`config`, vf.Map(`transport`, `ssh`, `ssh`, vf.Map(`user`, `root`))),
+				`config`, vf.Map(`transport`, `ssh`, `ssh`, vf.Map(`user`, `root`)),
+				`groups`, vf.Values(`ssh_nodes`, `memcached`)),
 			vf.Map(
 				`id`, `cmVhbG1fYS5tYzI=`,
 				`name`, `mc2`,
 				`realm`, `realm_a`,
 				`uri`, `192.168.101.60`,
-				`config`, vf.Map(`transport`, `ssh`, `ssh`, vf.Map(`user`, `root`)))),
+				`config`, vf.Map(`transport`, `ssh`, `ssh`, vf.Map(`user`, `root`)),
+				`groups`, vf.Values(`ssh_nodes`, `memcached`))),
 		queryResult(qr))
 }
 
 func TestQuery_match(t *testing.T) {
 	b := bolt.NewStorage(staticDir())
-	_, qr := b.Query(`targets`, vf.Map(`target`, `172.16`))
+	_, qr, _ := b.Query(ctx, `targets`, vf.Map(`target`, `172.16`))
 	require.Equal(t,
 		vf.Values(
 			vf.Map(
 				`id`, `cmVhbG1fYS4xNzIuMTYuMjE5LjIw`,
 				`realm`, `realm_a`,
 				`uri`, `172.16.219.20`,
-				`config`, vf.Map(`transport`, `winrm`, `winrm`, vf.Map(`realm`, `MYDOMAIN`, `ssl`, false))),
+				`config`, vf.Map(`transport`, `winrm`, `winrm`, vf.Map(`realm`, `MYDOMAIN`, `ssl`, false)),
+				`groups`, vf.Values(`win_nodes`, `testservers`)),
 			vf.Map(
 				`id`, `cmVhbG1fYS4xNzIuMTYuMjE5LjMw`,
 				`realm`, `realm_a`,
 				`uri`, `172.16.219.30`,
-				`config`, vf.Map(`transport`, `winrm`, `winrm`, vf.Map(`realm`, `MYDOMAIN`, `ssl`, false)))),
+				`config`, vf.Map(`transport`, `winrm`, `winrm`, vf.Map(`realm`, `MYDOMAIN`, `ssl`, false)),
+				`groups`, vf.Values(`win_nodes`, `testservers`))),
 		queryResult(qr))
 }
 
+func TestQuery_memberOf(t *testing.T) {
+	b := bolt.NewStorage(staticDir())
+	_, qr, _ := b.Query(ctx, `targets`, vf.Map(`memberOf`, `ssh_nodes`))
+	require.Equal(t, 5, qr.Len())
+
+	_, qr, _ = b.Query(ctx, `realm_a.targets`, vf.Map(`memberOf`, `testservers`))
+	require.Equal(t, 2, qr.Len())
+
+	_, qr, _ = b.Query(ctx, `targets`, vf.Map(`memberOf`, `ssh`))
+	require.Nil(t, qr)
+}
+
+func TestGet_memberGroups(t *testing.T) {
+	b := bolt.NewStorage(staticDir())
+	_, v, _ := b.Get(ctx, `realm_b.mytarget.groups`)
+	require.Equal(t, vf.Values(`group1`, `group2`), v)
+}
+
+func TestGet_explain(t *testing.T) {
+	b := bolt.NewStorage(staticDir())
+	_, v, _ := b.Get(ctx, `target.cmVhbG1fYi5teXRhcmdldA==.explain`)
+	require.Equal(t,
+		vf.Map(
+			`config`, vf.Values(
+				vf.Map(`key`, `ssh.host-key-check`, `value`, false, `source`, `realm_b/group1`, `overrides`, vf.Values()),
+				vf.Map(`key`, `ssh.password`, `value`, `bolt`, `source`, `realm_b/group2/mytarget`,
+					`overrides`, vf.Values(vf.Map(`value`, `password`, `source`, `realm_b/group2`))),
+				vf.Map(`key`, `ssh.user`, `value`, `puppet`, `source`, `realm_b/group1/mytarget`, `overrides`, vf.Values())),
+			`facts`, vf.Values(
+				vf.Map(`key`, `hardwaremodel`, `value`, `x86_64`, `source`, `realm_b/group1/mytarget`, `overrides`, vf.Values()),
+				vf.Map(`key`, `operatingsystem`, `value`, `CentOS`, `source`, `realm_b/group2`, `overrides`, vf.Values())),
+			`vars`, vf.Values()),
+		v)
+
+	_, v, _ = b.Get(ctx, `target.cmVhbG1fYS5tYzE=.explain.config.2.overrides.0.source`)
+	require.Equal(t, `realm_a/ssh_nodes`, v)
+}
+
+func TestGet_explainMultipleDeclarations(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	inv := `version: 2
+config:
+  ssh:
+    port: 22
+    user: root
+groups:
+  - name: group1
+    config:
+      ssh:
+        port: 2222
+    targets:
+      - name: t1
+        uri: host1
+  - name: group2
+    targets:
+      - name: t1
+        uri: host1
+`
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_t.yaml`), []byte(inv), 0640))
+	_, v, _ := bolt.NewStorage(dir).Get(ctx, `target.cmVhbG1fdC50MQ==.explain.config`)
+
+	// The realm is layered once for each group, which reinstates a value that group1 overrode but must not
+	// record a value as an override of itself
+	require.Equal(t,
+		vf.Values(
+			vf.Map(`key`, `ssh.port`, `value`, 22, `source`, `realm_t`, `overrides`, vf.Values(
+				vf.Map(`value`, 2222, `source`, `realm_t/group1`),
+				vf.Map(`value`, 22, `source`, `realm_t`))),
+			vf.Map(`key`, `ssh.user`, `value`, `root`, `source`, `realm_t`, `overrides`, vf.Values())),
+		v)
+	_, v, _ = bolt.NewStorage(dir).Get(ctx, `realm_t.t1.config.ssh`)
+	require.Equal(t, vf.Map(`port`, 22, `user`, `root`), v)
+}
+
 func TestGet_target(t *testing.T) {
 	b := bolt.NewStorage(staticDir())
-	_, trg := b.Get(`realm_a.mc1`)
+	_, trg, _ := b.Get(ctx, `realm_a.mc1`)
 	v, ok := trg.(iapi.Resource)
 	require.True(t, ok)
 	require.Equal(t,
@@ -69,14 +164,787 @@ func TestGet_target(t *testing.T) {
 			`realm`, `realm_a`,
 			`name`, `mc1`,
 			`uri`, `192.168.101.50`,
-			`config`, vf.Map(`transport`, `ssh`, `ssh`, vf.Map(`user`, `root`))),
+			`config`, vf.Map(`transport`, `ssh`, `ssh`, vf.Map(`user`, `root`)),
+			`groups`, vf.Values(`ssh_nodes`, `memcached`)),
 		v.DataMap())
 }
 
+func TestGet_groups(t *testing.T) {
+	b := bolt.NewStorage(staticDir())
+	_, v, _ := b.Get(ctx, `realm_a.groups`)
+	gs, ok := v.(dgo.Array)
+	require.True(t, ok)
+	require.Equal(t, 2, gs.Len())
+	require.Equal(t, `inventory.realm_a.groups.ssh_nodes`, gs.Get(0).(iapi.Resource).RID(`inventory`))
+}
+
+func TestGet_group(t *testing.T) {
+	b := bolt.NewStorage(staticDir())
+	_, v, _ := b.Get(ctx, `realm_a.groups.memcached`)
+	g, ok := v.(iapi.Resource)
+	require.True(t, ok)
+	m := g.DataMap()
+	require.Equal(t, `memcached`, m.Get(`name`))
+	require.Equal(t, `realm_a`, m.Get(`realm`))
+	require.Equal(t, vf.Map(`ssh`, vf.Map(`user`, `root`)), m.Get(`config`))
+	require.Equal(t, vf.Values(), m.Get(`groups`))
+	tgs := m.Get(`targets`).(dgo.Array)
+	require.Equal(t, 2, tgs.Len())
+	require.Equal(t, `inventory.target.cmVhbG1fYS5tYzE=`, tgs.Get(0).(iapi.Resource).RID(`inventory`))
+
+	_, v, _ = b.Get(ctx, `realm_a.groups.ssh_nodes.config.ssh.user`)
+	require.Equal(t, `centos`, v)
+}
+
+func TestGroup_modifications(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	mods, _, err := b.Call(ctx, `realm_a.groups.ssh_nodes`, `addGroup`, vf.Map(`name`, `databases`, `targets`, vf.Values(`mc1`)))
+	require.Nil(t, err)
+	found := false
+	for _, mod := range mods {
+		if mod.ResourceName == `target.cmVhbG1fYS5tYzE=.explain` {
+			require.Equal(t, change.Reset, mod.Type)
+		}
+		if mod.ResourceName == `realm_a.groups.ssh_nodes.groups` && mod.Type == change.Add {
+			require.Equal(t, `inventory.realm_a.groups.databases`, mod.Value.(iapi.Resource).RID(`inventory`))
+			found = true
+		}
+	}
+	require.True(t, found)
+
+	mods, err = b.Delete(ctx, `realm_a.groups.databases`)
+	require.Ok(t, err)
+	found = false
+	for _, mod := range mods {
+		if mod.ResourceName == `realm_a.groups.databases` && mod.Type == change.Delete {
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestSet_target(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	mods, err := b.Set(ctx, `target.cmVhbG1fYS5tYzE=.config.ssh`, vf.Map(`user`, `admin`))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(mods))
+	require.Equal(t, `target.cmVhbG1fYS5tYzE=.config.ssh`, mods[0].ResourceName)
+	require.Equal(t, vf.Map(`user`, `admin`), mods[0].Value)
+	require.Equal(t, `target.cmVhbG1fYS5tYzE=.explain`, mods[1].ResourceName)
+	require.Equal(t, change.Reset, mods[1].Type)
+
+	_, v, _ := bolt.NewStorage(volatileDir(nil)).Get(ctx, `realm_a.mc1.config.ssh.user`)
+	require.Equal(t, `admin`, v)
+}
+
+func TestSet_pluginReference(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	_, err := b.Set(ctx, `target.cmVhbG1fYS5tYzE=.config`, vf.Map(`ssh`, vf.Map(`_plugin`, `env_var`, `var`, `HOME`)))
+	_, ok := err.(iapi.InvalidData)
+	require.True(t, ok)
+
+	_, _, err = b.Call(ctx, `realm_a.groups`, `addGroup`, vf.Map(`name`, `g1`, `targets`, vf.Values(vf.Map(`_plugin`, `cmdb`))))
+	_, ok = err.(iapi.InvalidData)
+	require.True(t, ok)
+}
+
+func TestSet_stringTarget(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	_, err := b.Set(ctx, `target.cmVhbG1fYS4xOTIuMTY4LjEwMC4xNzk=`, vf.Map(`facts`, vf.Map(`os`, `centos`)))
+	require.Nil(t, err)
+
+	_, v, _ := bolt.NewStorage(volatileDir(nil)).Get(ctx, `target.cmVhbG1fYS4xOTIuMTY4LjEwMC4xNzk=`)
+	require.Equal(t,
+		vf.Map(
+			`id`, `cmVhbG1fYS4xOTIuMTY4LjEwMC4xNzk=`,
+			`realm`, `realm_a`,
+			`uri`, `192.168.100.179`,
+			`config`, vf.Map(`transport`, `ssh`, `ssh`, vf.Map(`user`, `centos`, `private-key`, `~/.ssh/id_rsa`, `host-key-check`, false)),
+			`facts`, vf.Map(`os`, `centos`),
+			`groups`, vf.Values(`ssh_nodes`, `webservers`)),
+		v.(iapi.Resource).DataMap())
+}
+
+func TestSet_notFound(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	_, err := b.Set(ctx, `realm_a.nosuchtarget`, vf.Map(`facts`, vf.Map(`os`, `centos`)))
+	require.Equal(t, iapi.NotFound(`realm_a.nosuchtarget`), err)
+}
+
+func TestDelete_target(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	mods, err := b.Delete(ctx, `target.cmVhbG1fYS5tYzE=`)
+	require.Ok(t, err)
+	require.Equal(t, 4, len(mods))
+	require.Equal(t, `targets`, mods[0].ResourceName)
+	require.Equal(t, change.Remove, mods[0].Type)
+	require.Equal(t, `realm_a.targets`, mods[1].ResourceName)
+	require.Equal(t, change.Remove, mods[1].Type)
+	require.Equal(t, `realm_a.groups.memcached.targets`, mods[2].ResourceName)
+	require.Equal(t, change.Remove, mods[2].Type)
+	require.Equal(t, `target.cmVhbG1fYS5tYzE=`, mods[3].ResourceName)
+	require.Equal(t, change.Delete, mods[3].Type)
+
+	_, v, _ := bolt.NewStorage(volatileDir(nil)).Get(ctx, `realm_a.mc1`)
+	require.Nil(t, v)
+}
+
+func TestDelete_stringTarget(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	_, err := b.Delete(ctx, `target.cmVhbG1fYS4xOTIuMTY4LjEwMC4xNzk=`)
+	require.Ok(t, err)
+
+	_, v, _ := bolt.NewStorage(volatileDir(nil)).Get(ctx, `target.cmVhbG1fYS4xOTIuMTY4LjEwMC4xNzk=`)
+	require.Nil(t, v)
+}
+
+func TestDelete_group(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	mods, err := b.Delete(ctx, `realm_a.groups.memcached`)
+	require.Ok(t, err)
+	require.Equal(t, 8, len(mods))
+
+	_, qr, _ := bolt.NewStorage(volatileDir(nil)).Query(ctx, `targets`, vf.Map(`target`, `mc`))
+	require.Nil(t, qr)
+}
+
+func TestDelete_notFound(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	_, err := b.Delete(ctx, `realm_a.groups.nosuchgroup`)
+	require.Equal(t, iapi.NotFound(`realm_a.groups.nosuchgroup`), err)
+	_, err = b.Delete(ctx, `target.invalid`)
+	require.Equal(t, iapi.NotFound(`target.invalid`), err)
+}
+
+func TestCall_addGroup(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	_, _, err := b.Call(ctx, `realm_a.groups.ssh_nodes`, `addGroup`,
+		vf.Map(`name`, `databases`, `targets`, vf.Values(`mc1`), `facts`, vf.Map(`role`, `db`)))
+	require.Nil(t, err)
+
+	_, v, _ := bolt.NewStorage(volatileDir(nil)).Get(ctx, `realm_a.mc1.facts.role`)
+	require.Equal(t, `db`, v)
+
+	_, _, err = b.Call(ctx, `realm_a.groups`, `addGroup`, vf.Map(`name`, `databases`))
+	require.NotNil(t, err)
+}
+
+func TestCall_removeGroup(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	_, _, err := b.Call(ctx, `realm_a.groups.ssh_nodes`, `removeGroup`, vf.Map(`name`, `memcached`))
+	require.Nil(t, err)
+
+	_, v, _ := bolt.NewStorage(volatileDir(nil)).Get(ctx, `realm_a.mc1`)
+	require.Nil(t, v)
+
+	_, _, err = b.Call(ctx, `realm_a.groups`, `removeGroup`, vf.Map(`name`, `memcached`))
+	require.Equal(t, iapi.NotFound(`memcached`), err)
+}
+
+func TestCall_addTarget(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	mods, _, err := b.Call(ctx, `realm_a.groups.webservers`, `addTarget`, vf.Map(`target`, `mc1`))
+	require.Nil(t, err)
+	require.True(t, len(mods) > 0)
+
+	_, qr, _ := bolt.NewStorage(volatileDir(nil)).Query(ctx, `targets`, vf.Map(`group`, `webservers`))
+	require.Equal(t, 4, qr.Len())
+
+	_, _, err = b.Call(ctx, `realm_a.groups.webservers`, `addTarget`, vf.Map(`target`, `nosuchtarget`))
+	require.Equal(t, iapi.NotFound(`nosuchtarget`), err)
+}
+
+func TestCall_moveTarget(t *testing.T) {
+	b := bolt.NewStorage(volatileDir(t))
+	_, _, err := b.Call(ctx, `realm_a.groups.memcached`, `moveTarget`, vf.Map(`target`, `mc1`, `to`, `webservers`))
+	require.Nil(t, err)
+
+	_, v, _ := bolt.NewStorage(volatileDir(nil)).Get(ctx, `realm_a.mc1.config.ssh.user`)
+	require.Equal(t, `centos`, v)
+
+	_, qr, _ := b.Query(ctx, `targets`, vf.Map(`group`, `memcached`))
+	require.Equal(t, 1, qr.Len())
+
+	_, _, err = b.Call(ctx, `realm_a.groups.memcached`, `moveTarget`, vf.Map(`target`, `mc1`, `to`, `webservers`))
+	require.Equal(t, iapi.NotFound(`mc1`), err)
+}
+
+func TestGet_pluginTargets(t *testing.T) {
+	b := bolt.NewStorage(absTestDir(filepath.Join(`static`, `plugins`)))
+	_, v, _ := b.Get(ctx, `realm_p.p2.uri`)
+	require.Equal(t, `192.168.200.2`, v)
+	_, v, _ = b.Get(ctx, `realm_p.p1.facts.os`)
+	require.Equal(t, `centos`, v)
+	_, v, _ = b.Get(ctx, `realm_p.targets.2.uri`)
+	require.Equal(t, `192.168.200.3`, v)
+}
+
+func TestGet_pluginValues(t *testing.T) {
+	b := bolt.NewStorage(absTestDir(filepath.Join(`static`, `plugins`)))
+	_, v, _ := b.Get(ctx, `realm_p.p1.config.ssh.password`)
+	require.Equal(t, `secret`, v)
+	_, v, _ = b.Get(ctx, `realm_p.p1.vars.region`)
+	require.Equal(t, `eu-north-1`, v)
+
+	require.Ok(t, os.Setenv(`INVENTORY_TEST_REGION`, `us-west-2`))
+	defer func() {
+		_ = os.Unsetenv(`INVENTORY_TEST_REGION`)
+	}()
+	_, v, _ = bolt.NewStorage(absTestDir(filepath.Join(`static`, `plugins`))).Get(ctx, `realm_p.p1.vars.region`)
+	require.Equal(t, `us-west-2`, v)
+}
+
+func TestGet_registeredPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	bolt.RegisterPlugin(`test_double`, bolt.PluginFunc(func(_ bolt.ResolveContext, params dgo.Map) (dgo.Value, error) {
+		s := params.Get(`value`).String()
+		return vf.String(s + s), nil
+	}))
+	inv := "version: 2\ntargets:\n  - name: t1\n    uri: {_plugin: test_double, value: ab}\n"
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_t.yaml`), []byte(inv), 0640))
+	_, v, _ := bolt.NewStorage(dir).Get(ctx, `realm_t.t1.uri`)
+	require.Equal(t, `abab`, v)
+}
+
+func TestGet_unknownPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	inv := "version: 2\ntargets:\n  - {_plugin: no_such_plugin}\n"
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_t.yaml`), []byte(inv), 0640))
+	_, v, _ := bolt.NewStorage(dir).Get(ctx, `status.errors.realm_t`)
+	require.Equal(t, `unknown plugin "no_such_plugin"`, v)
+}
+
+func TestRefresh_pluginDependency(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	inv := "version: 2\ntargets:\n  - {_plugin: yaml, filepath: data/targets.yaml}\n"
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_t.yaml`), []byte(inv), 0640))
+	require.Ok(t, os.Mkdir(filepath.Join(dir, `data`), 0750))
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `data`, `targets.yaml`), []byte("- name: t1\n  uri: host1\n"), 0640))
+
+	b := bolt.NewStorage(dir)
+	_, v, _ := b.Get(ctx, `realm_t.t1.uri`)
+	require.Equal(t, `host1`, v)
+
+	// Wait for the minimum refresh interval to pass
+	time.Sleep(1100 * time.Millisecond)
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `data`, `targets.yaml`), []byte("- name: t1\n  uri: host2\n"), 0640))
+	_, v, _ = b.Get(ctx, `realm_t.t1.uri`)
+	require.Equal(t, `host2`, v)
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	rf := filepath.Join(dir, `realm_t.yaml`)
+	require.Ok(t, ioutil.WriteFile(rf, []byte("version: 2\ntargets:\n  - name: t1\n    uri: host1\n"), 0640))
+
+	b := bolt.NewStorage(dir)
+	_, _, err = b.Get(ctx, `realm_t`)
+	require.Ok(t, err)
+	modc := make(chan []*change.Modification, 10)
+	w, err := b.Watch(ctx, func(mods []*change.Modification) { modc <- mods })
+	require.Ok(t, err)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	// Wait for the minimum refresh interval to pass
+	time.Sleep(1100 * time.Millisecond)
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_u.yaml`), []byte("version: 2\ntargets:\n  - 192.168.1.2\n"), 0640))
+	select {
+	case mods := <-modc:
+		require.True(t, len(mods) > 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal(`no modifications were detected`)
+	}
+
+	require.Ok(t, w.Close())
+	require.Ok(t, os.Remove(rf))
+	select {
+	case <-modc:
+		t.Fatal(`modifications were detected after the watch was closed`)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatch_renameSave(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	rf := filepath.Join(dir, `realm_r.yml`)
+	require.Ok(t, ioutil.WriteFile(rf, []byte("version: 2\ntargets:\n  - name: t1\n    uri: host1\n"), 0640))
+	modc, w := watchStorage(dir, `realm_r.t1`, t)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	// Save the way editors do, by writing a temporary file and renaming it
+	tf := filepath.Join(dir, `.realm_r.yml.swp`)
+	require.Ok(t, ioutil.WriteFile(tf, []byte("version: 2\ntargets:\n  - name: t1\n    uri: host2\n"), 0640))
+	require.Ok(t, os.Rename(tf, rf))
+	awaitMod(modc, isURIChange(`host2`), t)
+}
+
+func TestWatch_symlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// Mimic the layout of a Kubernetes ConfigMap volume
+	writeVersion := func(version, uri string) {
+		vd := filepath.Join(dir, version)
+		require.Ok(t, os.Mkdir(vd, 0750))
+		require.Ok(t, ioutil.WriteFile(filepath.Join(vd, `realm_s.yaml`),
+			[]byte("version: 2\ntargets:\n  - name: t1\n    uri: "+uri+"\n"), 0640))
+	}
+	writeVersion(`..v1`, `host1`)
+	require.Ok(t, os.Symlink(`..v1`, filepath.Join(dir, `..data`)))
+	require.Ok(t, os.Symlink(filepath.Join(`..data`, `realm_s.yaml`), filepath.Join(dir, `realm_s.yaml`)))
+	modc, w := watchStorage(dir, `realm_s.t1`, t)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	writeVersion(`..v2`, `host2`)
+	require.Ok(t, os.Symlink(`..v2`, filepath.Join(dir, `..data_tmp`)))
+	require.Ok(t, os.Rename(filepath.Join(dir, `..data_tmp`), filepath.Join(dir, `..data`)))
+	require.Ok(t, os.RemoveAll(filepath.Join(dir, `..v1`)))
+	awaitMod(modc, isURIChange(`host2`), t)
+}
+
+func TestWatch_directoryRecreated(t *testing.T) {
+	tmp, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(tmp)
+	}()
+	dir := filepath.Join(tmp, `inv`)
+	writeRealm := func(uri string) {
+		require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_d.yaml`),
+			[]byte("version: 2\ntargets:\n  - name: t1\n    uri: "+uri+"\n"), 0640))
+	}
+	require.Ok(t, os.Mkdir(dir, 0750))
+	writeRealm(`host1`)
+	modc, w := watchStorage(dir, `realm_d.t1`, t)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	require.Ok(t, os.RemoveAll(dir))
+	awaitMod(modc, func(mod *change.Modification) bool {
+		return mod.ResourceName == `status` && mod.Value.(dgo.Map).Get(`watch`) != nil
+	}, t)
+
+	require.Ok(t, os.Mkdir(dir, 0750))
+	writeRealm(`host2`)
+	awaitMod(modc, isURIChange(`host2`), t)
+}
+
+func TestWatch_incremental(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_a.yaml`), []byte("version: 2\ntargets:\n  - 10.0.0.1\n  - 10.0.0.2\n"), 0640))
+	rf := filepath.Join(dir, `realm_b.yaml`)
+	require.Ok(t, ioutil.WriteFile(rf, []byte("version: 2\ntargets:\n  - 10.0.0.3\n"), 0640))
+	modc, w := watchStorage(dir, `targets`, t)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	// The new target is added to the slice of realm_b in the targets list
+	require.Ok(t, ioutil.WriteFile(rf, []byte("version: 2\ntargets:\n  - 10.0.0.3\n  - 10.0.0.4\n"), 0640))
+	awaitMod(modc, func(mod *change.Modification) bool {
+		return mod.ResourceName == `targets` && mod.Type == change.Add && mod.Index == 3
+	}, t)
+}
+
+func TestWatch_concurrentReads(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_b.yaml`), []byte("version: 2\ntargets:\n  - 10.0.0.1\n"), 0640))
+
+	// Each generation changes the vars of all targets in realm_c and adds or removes targets
+	rf := filepath.Join(dir, `realm_c.yaml`)
+	writeGeneration := func(gen int) {
+		yml := &strings.Builder{}
+		fmt.Fprintf(yml, "version: 2\ngroups:\n  - name: g1\n    vars:\n      gen: %d\n    targets:\n", gen)
+		for i := 0; i < 3+gen%3; i++ {
+			fmt.Fprintf(yml, "      - 10.0.1.%d\n", i+1)
+		}
+		require.Ok(t, ioutil.WriteFile(rf, []byte(yml.String()), 0640))
+	}
+	writeGeneration(0)
+
+	b := bolt.NewStorage(dir)
+	_, _, err = b.Get(ctx, `targets`)
+	require.Ok(t, err)
+	var published int32
+	w, err := b.Watch(ctx, func(mods []*change.Modification) { atomic.AddInt32(&published, 1) })
+	require.Ok(t, err)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := checkGeneration(b); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for gen := 1; gen <= 10; gen++ {
+		time.Sleep(150 * time.Millisecond)
+		writeGeneration(gen)
+	}
+	time.Sleep(150 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	require.True(t, atomic.LoadInt32(&published) > 0)
+}
+
+// checkGeneration reads the targets of realm_c in several ways and verifies that each read observes one
+// consistent generation of the realm file.
+func checkGeneration(b bolt.Storage) error {
+	_, v, err := b.Get(ctx, `realm_c.targets`)
+	if err != nil {
+		return err
+	}
+	ts := v.(dgo.Array)
+	gen := ts.Get(0).(iapi.Resource).DataMap().Get(`vars`).(dgo.Map).Get(`gen`).(dgo.Integer).GoInt()
+	if ts.Len() != 3+int(gen)%3 {
+		return fmt.Errorf(`generation %d has %d targets`, gen, ts.Len())
+	}
+	for i := 0; i < ts.Len(); i++ {
+		if g := ts.Get(i).(iapi.Resource).DataMap().Get(`vars`).(dgo.Map).Get(`gen`); !vf.Integer(gen).Equals(g) {
+			return fmt.Errorf(`generation %d is mixed with generation %s`, gen, g)
+		}
+	}
+
+	_, qr, err := b.Query(ctx, `targets`, vf.Map(`group`, `g1`))
+	if err != nil {
+		return err
+	}
+	qv := queryResult(qr).(dgo.Array)
+	gen = qv.Get(0).(dgo.Map).Get(`vars`).(dgo.Map).Get(`gen`).(dgo.Integer).GoInt()
+	if qv.Len() != 3+int(gen)%3 {
+		return fmt.Errorf(`query of generation %d has %d targets`, gen, qv.Len())
+	}
+
+	if _, v, err = b.Get(ctx, `realm_c.groups.g1.targets`); err != nil {
+		return err
+	}
+	if _, v, err = b.Get(ctx, `target.`+ts.Get(0).(iapi.Resource).ID()+`.explain`); err != nil {
+		return err
+	}
+	if v == nil {
+		return fmt.Errorf(`no explanation for target %s`, ts.Get(0))
+	}
+	_, _, err = b.Get(ctx, `status`)
+	return err
+}
+
+// watchStorage creates a storage for the given directory, gets the given key, and starts watching the
+// storage.
+func watchStorage(dir, key string, t *testing.T) (chan []*change.Modification, io.Closer) {
+	t.Helper()
+	b := bolt.NewStorage(dir)
+	_, v, err := b.Get(ctx, key)
+	require.Ok(t, err)
+	require.NotNil(t, v)
+	modc := make(chan []*change.Modification, 10)
+	w, err := b.Watch(ctx, func(mods []*change.Modification) { modc <- mods })
+	require.Ok(t, err)
+	return modc, w
+}
+
+// awaitMod waits for a modification that satisfies the given predicate to be passed to the watch
+func awaitMod(modc chan []*change.Modification, pred func(*change.Modification) bool, t *testing.T) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case mods := <-modc:
+			for _, mod := range mods {
+				if pred(mod) {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal(`the expected modification was not detected`)
+		}
+	}
+}
+
+func isURIChange(uri string) func(*change.Modification) bool {
+	return func(mod *change.Modification) bool {
+		if m, ok := mod.Value.(dgo.Map); ok && mod.Type == change.Change {
+			return vf.String(uri).Equals(m.Get(`uri`))
+		}
+		return false
+	}
+}
+
+func TestGet_execPlugin(t *testing.T) {
+	dir := pluginTestDir(t,
+		"version: 2\n"+
+			"targets:\n"+
+			"  - {_plugin: cmdb, hosts: [h1, h2]}\n"+
+			"config: {_plugin: echo, ssh: {user: root}}\n",
+		map[string]string{
+			`cmdb.sh`: `echo '[{"name": "h1", "uri": "10.0.0.1"}, {"name": "h2", "uri": "10.0.0.2"}]'`,
+			`echo`:    `read -r input; echo "{\"value\": $input}"`,
+		})
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	b := bolt.NewStorage(dir, bolt.PluginDir(filepath.Join(dir, `plugins`)))
+	_, v, _ := b.Get(ctx, `realm_t.h2.uri`)
+	require.Equal(t, `10.0.0.2`, v)
+	_, v, _ = b.Get(ctx, `realm_t.h1.config.ssh.user`)
+	require.Equal(t, `root`, v)
+}
+
+func TestGet_execPluginCache(t *testing.T) {
+	dir := pluginTestDir(t,
+		"version: 2\n"+
+			"targets:\n"+
+			"  - name: t1\n"+
+			"    uri: {_plugin: count, host: h1}\n"+
+			"  - name: t2\n"+
+			"    uri: {_plugin: count, host: h1}\n"+
+			"  - name: t3\n"+
+			"    uri: {_plugin: count, host: h3}\n",
+		map[string]string{`count`: `echo x >> ../count.txt; echo '"10.0.0.1"'`})
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	b := bolt.NewStorage(dir, bolt.PluginDir(filepath.Join(dir, `plugins`)))
+	_, v, _ := b.Get(ctx, `realm_t.t2.uri`)
+	require.Equal(t, `10.0.0.1`, v)
+
+	// Two invocations, one for each unique set of parameters
+	bs, err := ioutil.ReadFile(filepath.Join(dir, `count.txt`))
+	require.Ok(t, err)
+	require.Equal(t, "x\nx\n", string(bs))
+}
+
+func TestGet_execPluginFailure(t *testing.T) {
+	dir := pluginTestDir(t,
+		"version: 2\ntargets:\n  - {_plugin: fail}\n",
+		map[string]string{`fail`: `echo 'cmdb is down' >&2; exit 1`})
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	b := bolt.NewStorage(dir, bolt.PluginDir(filepath.Join(dir, `plugins`)))
+	_, v, _ := b.Get(ctx, `status.errors.realm_t`)
+	require.Match(t, `cmdb is down`, v)
+	_, v, _ = b.Get(ctx, `realm_t.targets`)
+	require.Equal(t, vf.Values(), v)
+}
+
+func TestGet_execPluginTimeout(t *testing.T) {
+	dir := pluginTestDir(t,
+		"version: 2\ntargets:\n  - {_plugin: slow}\n",
+		map[string]string{`slow`: `exec sleep 5`})
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	b := bolt.NewStorage(dir, bolt.PluginDir(filepath.Join(dir, `plugins`)), bolt.PluginTimeout(100*time.Millisecond))
+	_, v, _ := b.Get(ctx, `status.errors.realm_t`)
+	require.Match(t, `timed out after 100ms`, v)
+}
+
+func TestGet_execPluginTraversal(t *testing.T) {
+	dir := pluginTestDir(t,
+		"version: 2\ntargets:\n  - {_plugin: ../outside}\n",
+		map[string]string{`../outside`: `touch ../ran.txt; echo '[]'`})
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	b := bolt.NewStorage(dir, bolt.PluginDir(filepath.Join(dir, `plugins`)))
+	_, v, _ := b.Get(ctx, `status.errors.realm_t`)
+	require.Match(t, `invalid plugin name "\.\./outside"`, v)
+	_, err := os.Stat(filepath.Join(dir, `ran.txt`))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestGet_deadline(t *testing.T) {
+	dir := pluginTestDir(t,
+		"version: 2\ntargets:\n  - {_plugin: slow}\n",
+		map[string]string{`slow`: `exec sleep 5`})
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	b := bolt.NewStorage(dir, bolt.PluginDir(filepath.Join(dir, `plugins`)))
+	dc, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := b.Get(dc, `realm_t.targets`)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < time.Second)
+
+	// The aborted read is not recorded as an error of the realm, and the realm is read again
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `plugins`, `slow`), []byte("#!/bin/sh\necho '[\"192.168.1.1\"]'\n"), 0750))
+	_, v, err := b.Get(ctx, `status.errors`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(), v)
+	_, v, _ = b.Get(ctx, `realm_t.targets.0.uri`)
+	require.Equal(t, `192.168.1.1`, v)
+}
+
+func TestSet_realmWithError(t *testing.T) {
+	dir := pluginTestDir(t,
+		"version: 2\ntargets:\n  - {_plugin: fail}\n",
+		map[string]string{`fail`: `exit 1`})
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	b := bolt.NewStorage(dir, bolt.PluginDir(filepath.Join(dir, `plugins`)))
+	_, _, err := b.Call(ctx, `realm_t.groups`, `addGroup`, vf.Map(`name`, `g1`))
+	require.NotNil(t, err)
+	require.Match(t, `realm realm_t cannot be changed`, err.Error())
+	_, ok := err.(iapi.Conflict)
+	require.True(t, ok)
+}
+
+func TestGet_encrypted(t *testing.T) {
+	kp, err := pkcs7.LoadKeyPair(
+		absTestDir(filepath.Join(`static`, `keys`, `private_key.pkcs7.pem`)),
+		absTestDir(filepath.Join(`static`, `keys`, `public_key.pkcs7.pem`)))
+	require.Ok(t, err)
+	b := bolt.NewStorage(staticDir(), bolt.Keys(kp))
+	_, v, _ := b.Get(ctx, `target.cmVhbG1fYS4xOTIuMTY4LjExMC4xMA==.config.winrm.password`)
+	pw, ok := v.(dgo.Sensitive)
+	require.True(t, ok)
+	require.Equal(t, `S3cretP@ssword`, pw.Unwrap())
+
+	_, v, _ = bolt.NewStorage(staticDir()).Get(ctx, `target.cmVhbG1fYS4xOTIuMTY4LjExMC4xMA==.config.winrm.password`)
+	require.True(t, pkcs7.IsEncrypted(v.String()))
+}
+
 func staticDir() string {
 	return absTestDir(filepath.Join(`static`, `bolt`))
 }
 
+// volatileDir returns the directory of volatile bolt inventory files. The files are reset to the
+// contents of the static directory unless the given t is nil.
+func volatileDir(t *testing.T) string {
+	vd := absTestDir(filepath.Join(`volatile`, `bolt`))
+	if t == nil {
+		return vd
+	}
+	t.Helper()
+	if err := os.RemoveAll(vd); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(vd, 0750); err != nil {
+		t.Fatal(err)
+	}
+	sd := staticDir()
+	files, err := ioutil.ReadDir(sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		/* #nosec */
+		bs, err := ioutil.ReadFile(filepath.Join(sd, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(vd, f.Name()), bs, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return vd
+}
+
+// BenchmarkNewStorage_50kTargets measures the time it takes to load a realm with 50000 targets
+func BenchmarkNewStorage_50kTargets(b *testing.B) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	yml := &strings.Builder{}
+	yml.WriteString("version: 2\n")
+	writeBenchmarkGroups(yml, ``, 0)
+	if err = ioutil.WriteFile(filepath.Join(dir, `realm_x.yaml`), []byte(yml.String()), 0640); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, v, err := bolt.NewStorage(dir).Get(ctx, `targets`)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n := v.(dgo.Array).Len(); n != 50000 {
+			b.Fatalf(`expected 50000 targets, got %d`, n)
+		}
+	}
+}
+
+// writeBenchmarkGroups writes five levels of nested groups where each bottom level group has 16 targets
+func writeBenchmarkGroups(yml *strings.Builder, id string, level int) {
+	indent := strings.Repeat(`    `, level)
+	if level == 5 {
+		yml.WriteString(indent + "targets:\n")
+		for i := 0; i < 16; i++ {
+			fmt.Fprintf(yml, "%s  - name: t%s_%d\n%s    vars:\n%s      index: %d\n", indent, id, i, indent, indent, i)
+		}
+		return
+	}
+	fmt.Fprintf(yml, "%sconfig:\n%s  ssh:\n%s    port: %d\n%s    user: user%d\n", indent, indent, indent, 22+level, indent, level)
+	fmt.Fprintf(yml, "%sfacts:\n%s  level%d: %q\n", indent, indent, level, id)
+	fmt.Fprintf(yml, "%sfeatures:\n%s  - feature%d\n", indent, indent, level)
+	fmt.Fprintf(yml, "%svars:\n%s  var%d: %q\n", indent, indent, level, id)
+	yml.WriteString(indent + "groups:\n")
+	for i := 0; i < 5; i++ {
+		gid := fmt.Sprintf(`%s_%d`, id, i)
+		fmt.Fprintf(yml, "%s  - name: g%s\n", indent, gid)
+		writeBenchmarkGroups(yml, gid, level+1)
+	}
+}
+
 func absTestDir(dir string) string {
 	path, err := filepath.Abs(filepath.Join(`..`, `testdata`, dir))
 	if err != nil {
@@ -116,3 +984,19 @@ func queryResult(qr query.Result) dgo.Value {
 	})
 	return a
 }
+
+// pluginTestDir creates a temporary directory that contains a realm_t.yaml file with the given inventory, and a
+// plugins directory with the given shell scripts.
+func pluginTestDir(t *testing.T, inventory string, scripts map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `realm_t.yaml`), []byte(inventory), 0640))
+	pd := filepath.Join(dir, `plugins`)
+	require.Ok(t, os.Mkdir(pd, 0750))
+	for name, script := range scripts {
+		/* #nosec */
+		require.Ok(t, ioutil.WriteFile(filepath.Join(pd, name), []byte("#!/bin/sh\n"+script+"\n"), 0750))
+	}
+	return dir
+}
@@ -53,6 +53,7 @@ type Target interface {
 // data contains the properties that are common to both Group and Target
 type trg struct {
 	dta
+	ref dgo.String // string used when the target was declared by reference, nil for inline declarations
 }
 
 var targetType = tf.NewNamed(
@@ -84,11 +85,16 @@ func NewTarget(parent Group, input dgo.Map) Target {
 }
 
 func (t *trg) Config() dgo.Map {
-	merged := vf.Map()
-	for _, p := range t.AllParents() {
-		merged = DeepMerge(merged, p.LocalConfig())
+	if t.parent == nil {
+		return t.LocalConfig().Copy(false)
 	}
-	return DeepMerge(merged, t.LocalConfig())
+	return DeepMerge(t.parent.Config(), t.LocalConfig())
+}
+
+// clone returns a copy of this target with a copy of its input that can be modified without affecting this
+// target.
+func (t *trg) clone() *trg {
+	return &trg{dta: dta{parent: t.parent, input: t.input.Copy(false)}, ref: t.ref}
 }
 
 func (t *trg) Equals(other interface{}) bool {
@@ -103,20 +109,17 @@ func (t *trg) HasName(name dgo.String) bool {
 }
 
 func (t *trg) Facts() dgo.Map {
-	merged := vf.Map()
-	for _, p := range t.AllParents() {
-		merged = DeepMerge(merged, p.LocalFacts())
+	if t.parent == nil {
+		return t.LocalFacts().Copy(false)
 	}
-	return DeepMerge(merged, t.LocalFacts())
+	return DeepMerge(t.parent.Facts(), t.LocalFacts())
 }
 
 func (t *trg) Features() dgo.Array {
-	merged := vf.MutableValues()
-	for _, p := range t.AllParents() {
-		merged.AddAll(p.LocalFeatures())
+	if t.parent == nil {
+		return mergeFeatures(vf.Values(), t.LocalFeatures())
 	}
-	merged.AddAll(t.LocalFeatures())
-	return merged.Unique().Sort()
+	return mergeFeatures(t.parent.Features(), t.LocalFeatures())
 }
 
 func (t *trg) registerAlias(all dgo.Map) {
@@ -144,11 +147,11 @@ func (t *trg) DataMap() dgo.Map {
 }
 
 func (t *trg) ID() string {
-	return makeID(t.input.Get(realmV), t.input.Get(nameV), t.input.Get(idV))
+	return makeID(t.input.Get(realmV), t.input.Get(nameV), t.input.Get(uriV))
 }
 
 func (t *trg) RID(serviceName string) string {
-	return serviceName + `.target.` + makeID(t.input.Get(realmV), t.input.Get(nameV), t.input.Get(idV))
+	return serviceName + `.target.` + t.ID()
 }
 
 func (t *trg) Type() dgo.Type {
@@ -167,11 +170,26 @@ func (t *trg) URI() dgo.String {
 }
 
 func (t *trg) Vars() dgo.Map {
-	merged := vf.MutableMap()
-	for _, p := range t.AllParents() {
-		merged.PutAll(p.LocalVars())
+	if t.parent == nil {
+		return mergeVars(vf.Map(), t.LocalVars())
 	}
-	merged.PutAll(t.LocalVars())
+	return mergeVars(t.parent.Vars(), t.LocalVars())
+}
+
+// mergeFeatures returns a unique and sorted array with the features of both a and b
+func mergeFeatures(a, b dgo.Array) dgo.Array {
+	merged := vf.MutableValues()
+	merged.AddAll(a)
+	merged.AddAll(b)
+	return merged.Unique().Sort()
+}
+
+// mergeVars returns a new map that contains all vars from both a and b. The value of b takes precedence for
+// identical keys.
+func mergeVars(a, b dgo.Map) dgo.Map {
+	merged := vf.MutableMap()
+	merged.PutAll(a)
+	merged.PutAll(b)
 	return merged
 }
 
@@ -194,10 +212,16 @@ func (r *realm) mergeTargets(targets dgo.Array) Target {
 	facts := vf.Map()
 	features := vf.MutableValues()
 	vars := vf.MutableMap()
+	groups := vf.MutableValues()
 	var name dgo.String
 	var uri dgo.String
 	targets.Each(func(tv dgo.Value) {
 		t := tv.(Target)
+		for _, p := range t.AllParents()[1:] { // first parent is the realm itself
+			if groups.IndexOf(p.Name()) < 0 {
+				groups.Add(p.Name())
+			}
+		}
 		config = DeepMerge(config, t.Config())
 		facts = DeepMerge(facts, t.Facts())
 		features.AddAll(t.Features())
@@ -242,5 +266,8 @@ func (r *realm) mergeTargets(targets dgo.Array) Target {
 	if vars.Len() > 0 {
 		m.Put(varsV, vars)
 	}
+	if groups.Len() > 0 {
+		m.Put(groupsV, groups)
+	}
 	return NewTarget(nil, m)
 }
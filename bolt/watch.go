@@ -0,0 +1,262 @@
+package bolt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/puppetlabs/inventory/change"
+	"github.com/sirupsen/logrus"
+)
+
+// watchDelay is the time that the watch waits for more events before it acts on the events that it has
+// received. Editors and tools that save files typically cause several events in quick succession.
+const watchDelay = 100 * time.Millisecond
+
+// watchRetry is the interval between attempts to watch the inventory directory again after it has been
+// removed or after the watcher has reported an error.
+const watchRetry = time.Second
+
+// watch is the io.Closer returned from Watch
+type watch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close stops the watch and waits for it to finish
+func (w *watch) Close() error {
+	w.cancel()
+	<-w.done
+	return nil
+}
+
+// Watch starts watching the directory of the inventory files, and the directories of the files that plugin
+// references and symlinked inventory files resolve to, for changes. The modifications that result from a
+// change are passed to onModify. The watch continues until the given context is done or the returned
+// io.Closer is closed.
+//
+// Events are collected until no event has been received for a short while. The realms that the events
+// concern are then read again regardless of the modification time of their files, so files that are
+// replaced by renaming another file, or by swapping a symlink, are detected. The watch is established again
+// when the inventory directory is removed and later recreated. Errors that prevent the storage from being
+// watched are reported as the watch property of the status resource.
+func (s *storage) Watch(ctx context.Context, onModify func([]*change.Modification)) (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(s.path); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watch{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		defer func() {
+			_ = watcher.Close()
+		}()
+		s.watchFunc(ctx, watcher, onModify)
+	}()
+	return w, nil
+}
+
+func (s *storage) watchFunc(ctx context.Context, watcher *fsnotify.Watcher, onModify func([]*change.Modification)) {
+	// Pick up changes made before the watch started. The realms are then considered up to date until the
+	// watch detects a change.
+	s.notify(ctx, onModify, func() []*change.Modification { return s.refresh(ctx) })
+	s.lock.Lock()
+	s.watches++
+	s.storeWatchState()
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.watches--
+		s.storeWatchState()
+		s.lock.Unlock()
+	}()
+
+	watched := map[string]bool{s.path: true}
+	s.watchDependencies(watcher, watched)
+	pending := make(map[string]bool)
+	var delay, retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			pending[event.Name] = true
+			delay = time.After(watchDelay)
+		case <-delay:
+			delay = nil
+			names := pending
+			pending = make(map[string]bool)
+			if names[s.path] {
+				// The directory itself was removed or renamed so the watch must be established again
+				_ = watcher.Remove(s.path)
+				retry = time.After(0)
+				continue
+			}
+			for name := range names {
+				if watched[name] {
+					if _, err := os.Stat(name); err != nil {
+						delete(watched, name)
+					}
+				}
+			}
+			s.notify(ctx, onModify, func() []*change.Modification { return s.refreshChanged(ctx, names) })
+			s.watchDependencies(watcher, watched)
+		case <-retry:
+			retry = nil
+			if err := watcher.Add(s.path); err != nil {
+				s.watchFailed(ctx, onModify, fmt.Errorf(`unable to watch %s: %s`, s.path, err.Error()))
+				retry = time.After(watchRetry)
+				continue
+			}
+			watched = map[string]bool{s.path: true}
+			s.notify(ctx, onModify, func() []*change.Modification { return s.refreshChanged(ctx, nil) })
+			s.watchDependencies(watcher, watched)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events might have been lost, so everything is read again once the watch is established again
+			s.watchFailed(ctx, onModify, fmt.Errorf(`error watching %s: %s`, s.path, err.Error()))
+			if retry == nil {
+				retry = time.After(watchRetry)
+			}
+		}
+	}
+}
+
+// notify calls onModify with the modifications produced by the given refresh function. A refresh that fails
+// is logged and reported in the status resource. A previously reported error is cleared when the refresh
+// succeeds.
+func (s *storage) notify(ctx context.Context, onModify func([]*change.Modification), refresh func() []*change.Modification) {
+	var mods []*change.Modification
+	err := func() (err error) {
+		defer recoverError(&err)
+		mods = refresh()
+		return nil
+	}()
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		logrus.Errorf("unable to refresh %s: %s", s.path, err.Error())
+	}
+	mods = s.setWatchError(err, mods)
+	if len(mods) > 0 {
+		onModify(mods)
+	}
+}
+
+// watchFailed logs the given error and reports it in the status resource
+func (s *storage) watchFailed(ctx context.Context, onModify func([]*change.Modification), err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	logrus.Error(err.Error())
+	if mods := s.setWatchError(err, nil); len(mods) > 0 {
+		onModify(mods)
+	}
+}
+
+// setWatchError sets, or clears when err is nil, the error that prevents the storage from being watched and
+// appends the resulting modifications of the status resource.
+func (s *storage) setWatchError(err error, mods []*change.Modification) []*change.Modification {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil && s.watchErr == nil {
+		return mods
+	}
+	s.watchErr = err
+	mods = s.statusModifications(mods)
+	s.storeWatchState()
+	return mods
+}
+
+// refreshChanged marks the realms that are affected by changes of the files with the given paths as stale,
+// or all realms if names is nil, and then refreshes the storage, including the list of inventory files.
+func (s *storage) refreshChanged(ctx context.Context, names map[string]bool) []*change.Modification {
+	s.lock.Lock()
+	s.scanDir = true
+	if names == nil {
+		s.markStale(``)
+	}
+	for name := range names {
+		s.markStale(name)
+	}
+	s.lock.Unlock()
+	return s.refresh(ctx)
+}
+
+// markStale marks the realms that are affected by a change of the file with the given path as stale. All
+// realms are marked when the path is empty or appoints a symlink, since the swap of a symlink such as the
+// ..data link of a Kubernetes ConfigMap volume can change the contents of any file.
+func (s *storage) markStale(path string) {
+	all := path == `` || strings.HasPrefix(filepath.Base(path), `..`)
+	if !all {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			all = true
+		}
+	}
+	for _, r := range s.realmMap {
+		if all || r.path == path || r.dependsOn(path) || r.resolvedPath() == path {
+			r.stale = true
+		}
+	}
+}
+
+// resolvedPath returns the path of the inventory file with all symlinks resolved, or an empty string if the
+// path cannot be resolved.
+func (r *realm) resolvedPath() string {
+	rp, err := filepath.EvalSymlinks(r.path)
+	if err != nil {
+		return ``
+	}
+	return rp
+}
+
+// watchDependencies adds the directories of all files that plugin references depend on, and the directories
+// that symlinked inventory files resolve to, to the given watcher unless they are already watched.
+func (s *storage) watchDependencies(watcher *fsnotify.Watcher, watched map[string]bool) {
+	realDir, err := filepath.EvalSymlinks(s.path)
+	if err != nil {
+		realDir = s.path
+	}
+	s.lock.Lock()
+	var dirs []string
+	addDir := func(dir string) {
+		if !watched[dir] {
+			watched[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, r := range s.realmMap {
+		for _, dep := range r.deps {
+			addDir(filepath.Dir(dep))
+		}
+		if rp := r.resolvedPath(); rp != `` && rp != r.path {
+			// Watching the inventory directory under another name would change the names of its events
+			if dir := filepath.Dir(rp); dir != realDir {
+				addDir(dir)
+			}
+		}
+	}
+	s.lock.Unlock()
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			logrus.Errorf("unable to watch directory %s: %s", dir, err.Error())
+		}
+	}
+}
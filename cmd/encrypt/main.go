@@ -0,0 +1,87 @@
+// Command encrypt encrypts values for use in inventory files. The result is written to stdout in the
+// form ENC[PKCS7,<base64>]. The value is read from the command line arguments or, when no arguments are
+// given, from stdin.
+//
+//	encrypt -createkeys
+//	encrypt 'S3cretP@ssword'
+//	encrypt -decrypt 'ENC[PKCS7,MIIB...]'
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/puppetlabs/inventory/pkcs7"
+)
+
+func main() {
+	keyDir := flag.String(`keydir`, `keys`, `directory containing the key files`)
+	privateKey := flag.String(`private-key`, ``, `path to the private key (default <keydir>/private_key.pkcs7.pem)`)
+	publicKey := flag.String(`public-key`, ``, `path to the public key (default <keydir>/public_key.pkcs7.pem)`)
+	createKeys := flag.Bool(`createkeys`, false, `create a new key pair`)
+	decrypt := flag.Bool(`decrypt`, false, `decrypt the value instead of encrypting it`)
+	flag.Parse()
+
+	if *privateKey == `` {
+		*privateKey = filepath.Join(*keyDir, `private_key.pkcs7.pem`)
+	}
+	if *publicKey == `` {
+		*publicKey = filepath.Join(*keyDir, `public_key.pkcs7.pem`)
+	}
+	if err := run(*privateKey, *publicKey, *createKeys, *decrypt, flag.Args()); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(privateKey, publicKey string, createKeys, decrypt bool, args []string) error {
+	if createKeys {
+		if err := os.MkdirAll(filepath.Dir(privateKey), 0750); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(publicKey), 0750); err != nil {
+			return err
+		}
+		_, err := pkcs7.CreateKeyPair(privateKey, publicKey)
+		return err
+	}
+
+	var value string
+	if len(args) > 0 {
+		value = strings.Join(args, ` `)
+	} else {
+		bs, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = string(bs)
+	}
+
+	if decrypt {
+		kp, err := pkcs7.LoadKeyPair(privateKey, ``)
+		if err != nil {
+			return err
+		}
+		plain, err := kp.Decrypt(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(plain)
+		return err
+	}
+
+	kp, err := pkcs7.LoadKeyPair(``, publicKey)
+	if err != nil {
+		return err
+	}
+	enc, err := kp.Encrypt([]byte(value))
+	if err != nil {
+		return err
+	}
+	fmt.Println(enc)
+	return nil
+}
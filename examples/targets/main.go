@@ -12,6 +12,7 @@ import (
 	"github.com/jirenius/go-res"
 	"github.com/puppetlabs/inventory/bolt"
 	"github.com/puppetlabs/inventory/inventory"
+	"github.com/puppetlabs/inventory/pkcs7"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,9 +21,13 @@ func main() {
 	s := res.NewService(inventory.ServiceName)
 	s.SetLogger(logrus.StandardLogger())
 	p := setupTest()
-	bs := bolt.NewStorage(p)
+	kd := filepath.Join(filepath.Dir(filepath.Dir(p)), `static`, `keys`)
+	keys, err := pkcs7.LoadKeyPair(filepath.Join(kd, `private_key.pkcs7.pem`), filepath.Join(kd, `public_key.pkcs7.pem`))
+	if err != nil {
+		panic(err)
+	}
+	bs := bolt.NewStorage(p, bolt.Keys(keys))
 	is := inventory.NewService(s, bs)
-	watcher := bs.Watch(is.Modifications)
 
 	// Start service in separate goroutine
 	stop := make(chan bool)
@@ -44,8 +49,8 @@ func main() {
 	select {
 	case <-c:
 		// Graceful stop
+		_ = is.Close()
 		_ = s.Shutdown()
-		_ = watcher.Close()
 	case <-stop:
 	}
 }
@@ -0,0 +1,163 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lyraproj/dgo/dgo"
+)
+
+// racyWindow is the time that must pass after a file or directory was modified before it is cached. File
+// systems record modification times with limited precision, so a change made shortly after the contents
+// were read might otherwise leave the modification time unchanged.
+const racyWindow = 2 * time.Second
+
+// dataCache caches the parsed data.yaml file and the names of the child directories of each level. An entry
+// is valid as long as the file or directory that it was read from has the same identity, modification time,
+// and size. While the storage is watched, entries are trusted without that check and the watch forgets the
+// entries of the levels that it rescans. The zero value is an empty cache.
+type dataCache struct {
+	lock sync.Mutex
+
+	// gen is incremented each time entries are forgotten so that a read that started before an entry was
+	// forgotten doesn't store an outdated entry
+	gen uint64
+
+	// trusted is true when the storage is watched
+	trusted bool
+
+	// data and children are keyed by the directory of the level
+	data     map[string]*cachedData
+	children map[string]*cachedChildren
+}
+
+type cachedData struct {
+	info os.FileInfo
+	data dgo.Map
+}
+
+type cachedChildren struct {
+	info  os.FileInfo
+	names []string
+}
+
+// getData returns the cached data of the level in the given directory, or nil if no valid entry exists. The
+// returned generation must be passed to putData when the data has been read.
+func (c *dataCache) getData(dir string) (dgo.Map, uint64) {
+	c.lock.Lock()
+	e, gen, trusted := c.data[dir], c.gen, c.trusted
+	c.lock.Unlock()
+	if e == nil {
+		return nil, gen
+	}
+	if !trusted && !unchanged(e.info, filepath.Join(dir, dataFile)) {
+		c.lock.Lock()
+		if c.data[dir] == e {
+			delete(c.data, dir)
+		}
+		c.lock.Unlock()
+		return nil, gen
+	}
+	return e.data, gen
+}
+
+// putData stores the data of the level in the given directory unless entries have been forgotten since
+// the given generation was obtained. The info must be obtained before the data is read.
+func (c *dataCache) putData(dir string, gen uint64, info os.FileInfo, data dgo.Map) {
+	if racy(info) {
+		return
+	}
+	c.lock.Lock()
+	if c.gen == gen {
+		if c.data == nil {
+			c.data = make(map[string]*cachedData)
+		}
+		c.data[dir] = &cachedData{info: info, data: data}
+	}
+	c.lock.Unlock()
+}
+
+// getChildren returns the cached names of the child directories of the given directory, or nil if no valid
+// entry exists. The returned generation must be passed to putChildren when the names have been read.
+func (c *dataCache) getChildren(dir string) ([]string, uint64) {
+	c.lock.Lock()
+	e, gen, trusted := c.children[dir], c.gen, c.trusted
+	c.lock.Unlock()
+	if e == nil {
+		return nil, gen
+	}
+	if !trusted && !unchanged(e.info, dir) {
+		c.lock.Lock()
+		if c.children[dir] == e {
+			delete(c.children, dir)
+		}
+		c.lock.Unlock()
+		return nil, gen
+	}
+	return e.names, gen
+}
+
+// putChildren stores the names of the child directories of the given directory unless entries have been
+// forgotten since the given generation was obtained. The info must be obtained before the names are read.
+func (c *dataCache) putChildren(dir string, gen uint64, info os.FileInfo, names []string) {
+	if racy(info) {
+		return
+	}
+	c.lock.Lock()
+	if c.gen == gen {
+		if c.children == nil {
+			c.children = make(map[string]*cachedChildren)
+		}
+		c.children[dir] = &cachedChildren{info: info, names: names}
+	}
+	c.lock.Unlock()
+}
+
+// forget removes the entries of the level in the given directory, and of all levels beneath it if recursive
+// is true, together with the child names of its parent directory.
+func (c *dataCache) forget(dir string, recursive bool) {
+	c.lock.Lock()
+	c.gen++
+	delete(c.data, dir)
+	delete(c.children, dir)
+	delete(c.children, filepath.Dir(dir))
+	if recursive {
+		prefix := dir + string(filepath.Separator)
+		for d := range c.data {
+			if strings.HasPrefix(d, prefix) {
+				delete(c.data, d)
+			}
+		}
+		for d := range c.children {
+			if strings.HasPrefix(d, prefix) {
+				delete(c.children, d)
+			}
+		}
+	}
+	c.lock.Unlock()
+}
+
+// trust empties the cache and sets whether its entries are trusted without checking the file system
+func (c *dataCache) trust(trusted bool) {
+	c.lock.Lock()
+	c.gen++
+	c.trusted = trusted
+	c.data = nil
+	c.children = nil
+	c.lock.Unlock()
+}
+
+// unchanged returns true if the file at the given path has the identity, modification time, and size
+// described by the given info
+func unchanged(info os.FileInfo, path string) bool {
+	ci, err := os.Stat(path)
+	return err == nil && os.SameFile(info, ci) && info.ModTime().Equal(ci.ModTime()) && info.Size() == ci.Size()
+}
+
+// racy returns true if the file described by the given info was modified too recently to be cached
+func racy(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) < racyWindow
+}
@@ -0,0 +1,149 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	require "github.com/lyraproj/dgo/dgo_test"
+	"github.com/lyraproj/dgo/vf"
+)
+
+func TestDataCache_put(t *testing.T) {
+	dir, info := cacheTestDir(time.Now().Add(-time.Hour), t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	c := &dataCache{}
+	data, gen := c.getData(dir)
+	require.Nil(t, data)
+	c.putData(dir, gen, info, vf.Map(`a`, `x`))
+	data, _ = c.getData(dir)
+	require.Equal(t, vf.Map(`a`, `x`), data)
+}
+
+func TestDataCache_forgottenGeneration(t *testing.T) {
+	dir, info := cacheTestDir(time.Now().Add(-time.Hour), t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	c := &dataCache{}
+	_, gen := c.getData(dir)
+	names, cgen := c.getChildren(dir)
+	require.True(t, names == nil)
+
+	// Data that was read before the entry was forgotten might be outdated and must not be stored
+	c.forget(dir, false)
+	c.putData(dir, gen, info, vf.Map(`a`, `x`))
+	c.putChildren(dir, cgen, info, []string{`nodeA`})
+	data, gen := c.getData(dir)
+	require.Nil(t, data)
+	names, cgen = c.getChildren(dir)
+	require.True(t, names == nil)
+
+	// Emptying the cache also invalidates the generations obtained before
+	c.trust(true)
+	c.putData(dir, gen, info, vf.Map(`a`, `x`))
+	c.putChildren(dir, cgen, info, []string{`nodeA`})
+	data, _ = c.getData(dir)
+	require.Nil(t, data)
+	names, _ = c.getChildren(dir)
+	require.True(t, names == nil)
+}
+
+func TestDataCache_racy(t *testing.T) {
+	dir, info := cacheTestDir(time.Now(), t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	c := &dataCache{}
+	_, gen := c.getData(dir)
+	c.putData(dir, gen, info, vf.Map(`a`, `x`))
+	data, _ := c.getData(dir)
+	require.Nil(t, data)
+
+	_, gen = c.getChildren(dir)
+	c.putChildren(dir, gen, info, []string{`nodeA`})
+	names, _ := c.getChildren(dir)
+	require.True(t, names == nil)
+}
+
+func TestDataCache_changed(t *testing.T) {
+	dir, info := cacheTestDir(time.Now().Add(-time.Hour), t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	c := &dataCache{}
+	_, gen := c.getData(dir)
+	c.putData(dir, gen, info, vf.Map(`a`, `x`))
+
+	// The file keeps its size but gets a new modification time
+	path := filepath.Join(dir, dataFile)
+	require.Ok(t, ioutil.WriteFile(path, []byte("a: y\n"), 0640))
+	data, _ := c.getData(dir)
+	require.Nil(t, data)
+}
+
+func TestDataCache_trusted(t *testing.T) {
+	dir, info := cacheTestDir(time.Now().Add(-time.Hour), t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	c := &dataCache{}
+	c.trust(true)
+	_, gen := c.getData(dir)
+	c.putData(dir, gen, info, vf.Map(`a`, `x`))
+
+	// Trusted entries are valid until they are forgotten
+	path := filepath.Join(dir, dataFile)
+	require.Ok(t, ioutil.WriteFile(path, []byte("a: y\n"), 0640))
+	data, _ := c.getData(dir)
+	require.Equal(t, vf.Map(`a`, `x`), data)
+
+	c.forget(dir, false)
+	data, _ = c.getData(dir)
+	require.Nil(t, data)
+}
+
+func TestDataCache_forgetRecursive(t *testing.T) {
+	dir, info := cacheTestDir(time.Now().Add(-time.Hour), t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	c := &dataCache{}
+	c.trust(true)
+	child := filepath.Join(dir, `nodeA`)
+	_, gen := c.getData(dir)
+	c.putData(dir, gen, info, vf.Map(`a`, `x`))
+	c.putData(child, gen, info, vf.Map(`b`, `x`))
+	c.putChildren(dir, gen, info, []string{`nodeA`})
+
+	// Forgetting a level also forgets the child names of its parent
+	c.forget(child, false)
+	data, _ := c.getData(dir)
+	require.Equal(t, vf.Map(`a`, `x`), data)
+	names, _ := c.getChildren(dir)
+	require.True(t, names == nil)
+
+	_, gen = c.getData(dir)
+	c.putData(child, gen, info, vf.Map(`b`, `x`))
+	c.forget(dir, true)
+	data, _ = c.getData(child)
+	require.Nil(t, data)
+}
+
+// cacheTestDir returns a new temporary directory with a data.yaml file that has the given modification time,
+// together with the info of that file
+func cacheTestDir(modTime time.Time, t *testing.T) (string, os.FileInfo) {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	path := filepath.Join(dir, dataFile)
+	require.Ok(t, ioutil.WriteFile(path, []byte("a: x\n"), 0640))
+	require.Ok(t, os.Chtimes(path, modTime, modTime))
+	info, err := os.Stat(path)
+	require.Ok(t, err)
+	return dir, info
+}
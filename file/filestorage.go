@@ -2,11 +2,15 @@
 package file
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/puppetlabs/inventory/change"
 
@@ -16,14 +20,39 @@ import (
 	"github.com/lyraproj/dgo/dgo"
 	"github.com/lyraproj/dgo/vf"
 	"github.com/puppetlabs/inventory/iapi"
+	"github.com/puppetlabs/inventory/pkcs7"
 	"github.com/puppetlabs/inventory/yaml"
 )
 
 const valueKey = `__value`
 
+// createLockFile is the name of the file in the directory of a hierarchy entry that is locked while a child
+// entry is created
+const createLockFile = `.create.lock`
+
+// lockRetryDelay is the time to wait between attempts to obtain a file lock that is held by someone else
+const lockRetryDelay = 10 * time.Millisecond
+
 type fileStorage struct {
 	dataDir string
 	hns     []string
+	keys    *pkcs7.KeyPair
+
+	// lock serializes changes made by the storage with the scans of a watch
+	lock sync.Mutex
+
+	// levels is the data of each level keyed by its directory. It is nil unless the storage is watched
+	levels map[string]dgo.Map
+
+	// cache holds the data and the child names of the levels that have been read
+	cache dataCache
+
+	// schemaCache holds the schema declared in the schema file of the data directory
+	schemaCache schemaCache
+
+	// schemaData is the schema as last reported by the watch. It is nil unless the storage is watched and
+	// has a schema
+	schemaData dgo.Value
 }
 
 // NewStorage creates a Storage that is using the file system to persist data
@@ -31,70 +60,192 @@ func NewStorage(dataDir string, hierarchyNames ...string) iapi.Storage {
 	return &fileStorage{dataDir: dataDir, hns: hierarchyNames}
 }
 
-func (f *fileStorage) Delete(key string) ([]*change.Modification, bool) {
+// NewStorageWithKeys creates a Storage that is using the file system to persist data. The given keys are
+// used when decrypting ENC[PKCS7,...] strings and pkcs7 plugin references found in the data. The decrypted
+// values are sensitive.
+func NewStorageWithKeys(dataDir string, keys *pkcs7.KeyPair, hierarchyNames ...string) iapi.Storage {
+	return &fileStorage{dataDir: dataDir, hns: hierarchyNames, keys: keys}
+}
+
+func (f *fileStorage) Delete(ctx context.Context, key string) ([]*change.Modification, error) {
 	parts := strings.Split(key, `.`)
 	lp := len(parts) - 1
 	if lp < 1 {
-		return nil, false
+		return nil, iapi.NotFound(key)
 	}
-	if f.deleteChild(parts) {
-		return nil, true
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	mods, deleted, err := f.deleteChild(ctx, parts)
+	if err != nil || deleted {
+		if deleted {
+			f.synced(ctx, filepath.Join(f.dataDir, filepath.Join(parts...)))
+		}
+		return mods, err
 	}
 
 	// Delete from data.yaml
-	key = parts[lp]
+	vk := parts[lp]
 	parts = parts[:lp]
-	path := filepath.Join(f.dataDir, filepath.Join(parts...), `data.yaml`)
-	lock := flock.New(path)
-	err := lock.RLock()
+	dir := filepath.Join(f.dataDir, filepath.Join(parts...))
+	path := filepath.Join(dir, `data.yaml`)
+	lock, err := lockFile(ctx, path, true)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, false
+			return nil, iapi.NotFound(key)
 		}
-		panic(err)
+		return nil, err
 	}
 
 	defer func() {
 		_ = lock.Close()
 	}()
-	pf := yaml.Read(path).Copy(false) // read, then thaw frozen map
-	if pf.Remove(key) != nil {
-		yaml.Write(path, pf)
-		return nil, true
+	pf, err := yaml.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if !pf.ContainsKey(vk) {
+		return nil, iapi.NotFound(key)
+	}
+	pf = pf.Copy(false) // thaw frozen map
+	pk := strings.Join(parts, `.`)
+	mods = change.Map(pk, pf, pf.Without(vk), nil)
+	if err = f.validate(pk, pf); err != nil {
+		return nil, err
+	}
+	if err = yaml.Write(path, pf); err != nil {
+		return nil, err
 	}
-	return nil, false
+	f.synced(ctx, dir)
+	return mods, nil
 }
 
-func (f *fileStorage) Get(key string) ([]*change.Modification, dgo.Value) {
+func (f *fileStorage) Get(ctx context.Context, key string) ([]*change.Modification, dgo.Value, error) {
 	parts := strings.Split(key, `.`)
-	pf := f.readData(parts)
+	if parts[0] == schemaKey {
+		v, err := f.getSchema(parts[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, v, nil
+	}
+	pf, err := f.readData(ctx, parts)
+	if err != nil {
+		return nil, nil, err
+	}
 	if pf != nil {
-		return nil, pf.Get(valueKey)
+		return f.decrypt(key, pf.Get(valueKey))
 	}
 	lp := len(parts) - 1
 	last := parts[lp]
 	parts = parts[:lp]
 	if lp > 0 {
-		if pf = f.readData(parts); pf == nil {
-			return nil, nil
+		if pf, err = f.readData(ctx, parts); pf == nil {
+			return nil, nil, err
 		}
 		if v := pf.Get(last); v != nil {
-			return nil, v
+			return f.decrypt(key, v)
 		}
 	}
-	if lp < len(f.hns) && last == f.hns[lp] {
+	if depth := f.listingDepth(lp, last); depth > 0 {
 		// Collect names of subdirectories.
-		children := f.readChildMap(parts)
-		if pf != nil {
+		children, err := f.readChildMap(ctx, parts, depth)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pf != nil && depth == 1 {
 			children = children.Merge(pf.WithoutAll(vf.Values(valueKey)))
 		}
-		return nil, children
+		return f.decrypt(key, children)
+	}
+	return nil, nil, nil
+}
+
+// dig returns the value found by using the given keys to dig into the given value, or nil if no such value
+// exists
+func dig(keys []string, v dgo.Value) dgo.Value {
+	for _, k := range keys {
+		switch c := v.(type) {
+		case dgo.Map:
+			v = c.Get(k)
+		case dgo.Array:
+			if i, err := strconv.Atoi(k); err == nil && i >= 0 && i < c.Len() {
+				v = c.Get(i)
+			} else {
+				v = nil
+			}
+		default:
+			v = nil
+		}
+	}
+	return v
+}
+
+// decrypt replaces all encrypted values in the given value with sensitive decrypted values
+func (f *fileStorage) decrypt(key string, v dgo.Value) ([]*change.Modification, dgo.Value, error) {
+	if v == nil {
+		return nil, nil, nil
+	}
+	dv, err := f.keys.DecryptValues(v)
+	if err != nil {
+		return nil, nil, iapi.InvalidData{Key: key, Reason: err.Error()}
+	}
+	return nil, dv, nil
+}
+
+// RealmOf returns the first segment of the given key unless the key appoints the schema or a listing that
+// spans all realms, such as the list of realms, in which case an empty string is returned.
+func (f *fileStorage) RealmOf(key string) string {
+	parts := strings.SplitN(key, `.`, 2)
+	if parts[0] == schemaKey || len(parts) == 1 && f.listingDepth(0, parts[0]) > 0 {
+		return ``
+	}
+	return parts[0]
+}
+
+// EntitySegments returns the number of leading segments of the given key that appoint an entry of the
+// hierarchy, i.e. that are names of directories, optionally followed by the name of a listing of entries.
+func (f *fileStorage) EntitySegments(key string) int {
+	parts := strings.Split(key, `.`)
+	if parts[0] == schemaKey {
+		return 1
+	}
+	hns := f.levelNames()
+	n := 0
+	for ; n < len(parts) && (len(hns) == 0 || n < len(hns)); n++ {
+		names, _ := f.readChildNames(filepath.Join(f.dataDir, filepath.Join(parts[:n]...)))
+		if !containsName(names, parts[n]) {
+			break
+		}
+	}
+	if n < len(parts) && f.listingDepth(n, parts[n]) > 0 {
+		n++
 	}
-	return nil, nil
+	return n
 }
 
-func (f *fileStorage) Query(key string, _ dgo.Map) (mods []*change.Modification, qr query.Result) {
-	mods, v := f.Get(key)
+// containsName returns true if the given names contain the given name
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fileStorage) Query(ctx context.Context, key string, q dgo.Map) (mods []*change.Modification, qr query.Result, err error) {
+	if q != nil && q.Len() > 0 {
+		parts := strings.Split(key, `.`)
+		lp := len(parts) - 1
+		if depth := f.listingDepth(lp, parts[lp]); depth > 0 {
+			qr, err = f.queryListing(ctx, key, parts[:lp], depth, q)
+			return nil, qr, err
+		}
+	}
+	mods, v, err := f.Get(ctx, key)
 	switch v := v.(type) {
 	case nil:
 	case dgo.Array:
@@ -110,18 +261,24 @@ func (f *fileStorage) Query(key string, _ dgo.Map) (mods []*change.Modification,
 	default:
 		qr = query.NewSingleResult(v)
 	}
-	return mods, qr
+	return mods, qr, err
 }
 
-func (f *fileStorage) QueryKeys(_ string) []query.Param {
-	return []query.Param{} // Not queryable at this time
+// QueryKeys returns the query parameters of the given key. Only listings of hierarchy entries are queryable.
+func (f *fileStorage) QueryKeys(key string) []query.Param {
+	parts := strings.Split(key, `.`)
+	lp := len(parts) - 1
+	if f.listingDepth(lp, parts[lp]) > 0 {
+		return listingQueryKeys
+	}
+	return []query.Param{}
 }
 
 func (f *fileStorage) Refresh() []*change.Modification {
 	return []*change.Modification{}
 }
 
-func (f *fileStorage) Set(key string, model dgo.Map) ([]*change.Modification, error) {
+func (f *fileStorage) Set(ctx context.Context, key string, model dgo.Map) ([]*change.Modification, error) {
 	if model.Len() == 0 {
 		return nil, nil
 	}
@@ -130,117 +287,285 @@ func (f *fileStorage) Set(key string, model dgo.Map) ([]*change.Modification, er
 	if lp < 0 {
 		return nil, iapi.NotFound(``)
 	}
-	path := filepath.Join(f.dataDir, filepath.Join(parts...), `data.yaml`)
+	if parts[0] == schemaKey {
+		return nil, iapi.Conflict{Key: key, Reason: `the schema can only be changed by editing its file`}
+	}
+	dir := filepath.Join(f.dataDir, filepath.Join(parts...))
+	path := filepath.Join(dir, `data.yaml`)
 
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// The file is locked exclusively until it has been replaced so that no other process can change it
+	// between the read and the write.
 	var mods []*change.Modification
 	var pf dgo.Map
-	lock := flock.New(path)
-	err := lock.RLock()
+	lock, err := lockFile(ctx, path, true)
+	create := model.Len() == 1 && model.Get(valueKey) != nil
+	if create && os.IsNotExist(err) {
+		// Entries are created while holding the creation lock of the parent so that an entry that another
+		// process creates meanwhile isn't overwritten.
+		var cl *flock.Flock
+		if cl, err = f.lockCreate(ctx, parts[:lp]); err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = cl.Close()
+		}()
+		lock, err = lockFile(ctx, path, true)
+	}
 	if err == nil {
 		defer func() {
 			_ = lock.Close()
 		}()
-		pf = yaml.Read(path).Copy(false) // read, then thaw frozen map
+		if pf, err = yaml.Read(path); err != nil {
+			return nil, err
+		}
+		pf = pf.Copy(false) // thaw frozen map
 		mods = change.Map(key, pf, pf.Merge(model), mods)
+		if err = f.validate(key, pf); err != nil {
+			return nil, err
+		}
 	} else {
 		if !os.IsNotExist(err) {
-			panic(err)
+			return nil, err
 		}
 
 		// A non existing data.yaml is OK if this is an attempt to create a new hierarchy entry. Such
 		// an attempt is only allowed if the model is a one element map with keyed by the valueKey
-		if value := model.Get(valueKey); value != nil && model.Len() == 1 {
-			f.createChild(parts)
+		if create {
+			if err = f.validate(key, model); err != nil {
+				return nil, err
+			}
+			if err = f.createChild(parts); err != nil {
+				return nil, err
+			}
 			pf = model
 			mods = append(mods, &change.Modification{ResourceName: key, Type: change.Create, Value: model})
 		} else {
 			return nil, iapi.NotFound(key)
 		}
 	}
-	yaml.Write(path, pf)
+	if err = yaml.Write(path, pf); err != nil {
+		return nil, err
+	}
+	f.synced(ctx, dir)
 	return mods, nil
 }
 
-func (f *fileStorage) createChild(parts []string) {
+// lockCreate obtains the exclusive creation lock of the hierarchy entry appointed by the given parts. The lock
+// is held while a child entry is created. A NotFound error is returned if the entry doesn't exist.
+func (f *fileStorage) lockCreate(ctx context.Context, parts []string) (*flock.Flock, error) {
+	dir := filepath.Join(f.dataDir, filepath.Join(parts...))
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, iapi.NotFound(strings.Join(parts, `.`))
+		}
+		return nil, iapi.IOError{Path: dir, Err: err}
+	}
+	path := filepath.Join(dir, createLockFile)
+	lock := flock.New(path)
+	ok, err := lock.TryLockContext(ctx, lockRetryDelay)
+	if err != nil {
+		_ = lock.Close()
+		if err == ctx.Err() {
+			return nil, err
+		}
+		return nil, iapi.IOError{Path: path, Err: err}
+	}
+	if !ok {
+		_ = lock.Close()
+		return nil, ctx.Err()
+	}
+	return lock, nil
+}
+
+func (f *fileStorage) createChild(parts []string) error {
 	dirPath := filepath.Join(f.dataDir, filepath.Join(parts...))
 	_, err := os.Stat(dirPath)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return iapi.IOError{Path: dirPath, Err: err}
+	}
+
+	// Directory does not exist. Ensure that parent directory does. It's always an
+	// error if the parent doesn't exist (can't add a node to a non existing realm).
+	pParts := parts[:len(parts)-1]
+	pDir := filepath.Join(f.dataDir, filepath.Join(pParts...))
+	pd, err := os.Stat(pDir)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			panic(err)
-		}
-
-		// Directory does not exist. Ensure that parent directory does. It's always an
-		// error if the parent doesn't exist (can't add a node to a non existing realm).
-		pParts := parts[:len(parts)-1]
-		pDir := filepath.Join(f.dataDir, filepath.Join(pParts...))
-		pd, err := os.Stat(pDir)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				panic(err)
-			}
-			panic(iapi.NotFound(strings.Join(pParts, `.`)))
-		}
-		if !pd.IsDir() {
-			panic(fmt.Errorf(`%q is not a directory`, pDir))
+			return iapi.IOError{Path: pDir, Err: err}
 		}
+		return iapi.NotFound(strings.Join(pParts, `.`))
+	}
+	if !pd.IsDir() {
+		return iapi.Conflict{Key: strings.Join(pParts, `.`), Reason: fmt.Sprintf(`%q is not a directory`, pDir)}
+	}
 
-		// Parent exists, so create the directory that represents the child.
-		err = os.Mkdir(dirPath, 0750)
-		if err != nil {
-			panic(err)
-		}
+	// Parent exists, so create the directory that represents the child.
+	if err = os.Mkdir(dirPath, 0750); err != nil {
+		return iapi.IOError{Path: dirPath, Err: err}
 	}
+	return nil
 }
 
-func (f *fileStorage) deleteChild(parts []string) bool {
+// deleteChild removes the directory of the hierarchy entry appointed by the given parts together with all
+// entries beneath it. It returns the modifications of the removed entries and true, or false if the directory
+// doesn't exist.
+func (f *fileStorage) deleteChild(ctx context.Context, parts []string) ([]*change.Modification, bool, error) {
 	path := filepath.Join(f.dataDir, filepath.Join(parts...))
 	ds, err := os.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return false
+			return nil, false, nil
 		}
-		panic(err)
+		return nil, false, iapi.IOError{Path: path, Err: err}
 	}
-	if ds.IsDir() {
-		if err = os.RemoveAll(path); err != nil {
-			panic(err)
-		}
-		return true
+	if !ds.IsDir() {
+		return nil, false, iapi.Conflict{Key: strings.Join(parts, `.`), Reason: fmt.Sprintf(`%q is not a directory`, path)}
 	}
-	panic(fmt.Errorf(`%q is not a directory`, path))
-}
 
-func (f *fileStorage) readChildMap(parts []string) dgo.Map {
-	dir := filepath.Join(f.dataDir, filepath.Join(parts...))
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	// Read the data of all removed entries so that their removal can be reported
+	var dirs []string
+	_ = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, p)
 		}
-		panic(err)
+		return nil
+	})
+	old := make([]dgo.Map, len(dirs))
+	for i, dir := range dirs {
+		if old[i], err = f.readData(ctx, f.partsOf(dir)); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err = os.RemoveAll(path); err != nil {
+		return nil, false, iapi.IOError{Path: path, Err: err}
+	}
+	var mods []*change.Modification
+	for i, dir := range dirs {
+		mods = f.levelMods(f.partsOf(dir), old[i], nil, mods)
 	}
+	return mods, true, nil
+}
 
+// readChildMap returns a map with the value of each entry that is the given depth beneath the entry appointed
+// by the given parts, keyed by the key of the entry relative to the parts. It returns nil and no error if the
+// entry appointed by the parts doesn't exist.
+func (f *fileStorage) readChildMap(ctx context.Context, parts []string, depth int) (dgo.Map, error) {
 	children := vf.MutableMap()
-	for _, file := range files {
-		if file.IsDir() {
-			dh := f.readData(append(parts, file.Name()))
-			children.Put(file.Name(), dh.Get(valueKey))
+	found, err := f.eachEntry(ctx, parts, depth, ``, func(rel, _ string, data dgo.Map) error {
+		children.Put(rel, data.Get(valueKey))
+		return nil
+	})
+	if !found || err != nil {
+		return nil, err
+	}
+	return children, nil
+}
+
+// readChildNames returns the names of the subdirectories of the given directory. It returns nil and no
+// error if the directory doesn't exist.
+func (f *fileStorage) readChildNames(dir string) ([]string, error) {
+	names, gen := f.cache.getChildren(dir)
+	if names != nil {
+		return names, nil
+	}
+	info, err := os.Stat(dir)
+	if err == nil {
+		var files []os.FileInfo
+		if files, err = ioutil.ReadDir(dir); err == nil {
+			names = make([]string, 0, len(files))
+			for _, file := range files {
+				if file.IsDir() {
+					names = append(names, file.Name())
+				}
+			}
+			f.cache.putChildren(dir, gen, info, names)
+			return names, nil
 		}
 	}
-	return children
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return nil, iapi.IOError{Path: dir, Err: err}
 }
 
-func (f *fileStorage) readData(parts []string) dgo.Map {
-	path := filepath.Join(f.dataDir, filepath.Join(parts...), `data.yaml`)
-	lock := flock.New(path)
-	if err := lock.RLock(); err != nil {
+// readData reads the data.yaml file of the level appointed by the given parts, or obtains it from the cache
+// if the file hasn't changed since it was last read. It returns nil and no error if no such file exists.
+func (f *fileStorage) readData(ctx context.Context, parts []string) (dgo.Map, error) {
+	dir := filepath.Join(f.dataDir, filepath.Join(parts...))
+	data, gen := f.cache.getData(dir)
+	if data != nil {
+		return data, nil
+	}
+	path := filepath.Join(dir, dataFile)
+	lock, err := lockFile(ctx, path, false)
+	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return nil, nil
 		}
-		panic(err)
+		return nil, err
 	}
 	defer func() {
 		_ = lock.Close()
 	}()
-	return yaml.Read(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, iapi.IOError{Path: path, Err: err}
+	}
+	if data, err = yaml.Read(path); err != nil {
+		return nil, err
+	}
+	f.cache.putData(dir, gen, info, data)
+	return data, nil
+}
+
+// lockFile obtains a lock on the file at the given path. The lock is exclusive if exclusive is true and
+// shared otherwise. It retries until the lock is obtained or the given context is done. An error for which
+// os.IsNotExist is true is returned when the file doesn't exist. The error of the context is returned when it
+// is done before the lock is obtained.
+//
+// Files are replaced rather than rewritten when they change, so a lock obtained on a file that was replaced
+// while waiting for the lock doesn't protect the current file. The lock is then obtained again.
+func lockFile(ctx context.Context, path string, exclusive bool) (*flock.Flock, error) {
+	for {
+		// Check existence first since obtaining the lock would create the file
+		before, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, err
+			}
+			return nil, iapi.IOError{Path: path, Err: err}
+		}
+		lock := flock.New(path)
+		var ok bool
+		if exclusive {
+			ok, err = lock.TryLockContext(ctx, lockRetryDelay)
+		} else {
+			ok, err = lock.TryRLockContext(ctx, lockRetryDelay)
+		}
+		if !ok {
+			_ = lock.Close()
+		}
+		if err != nil {
+			if os.IsNotExist(err) || err == ctx.Err() {
+				return nil, err
+			}
+			return nil, iapi.IOError{Path: path, Err: err}
+		}
+		if !ok {
+			return nil, ctx.Err()
+		}
+		if after, err := os.Stat(path); err == nil && os.SameFile(before, after) {
+			return lock, nil
+		}
+		_ = lock.Close()
+	}
 }
@@ -0,0 +1,173 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/typ"
+	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/iapi"
+	"github.com/puppetlabs/inventory/pkcs7"
+	"github.com/puppetlabs/inventory/query"
+)
+
+// factPrefix is the prefix of the query parameters that filter listings by the value of a fact
+const factPrefix = `fact`
+
+// listingQueryKeys are the query parameters of a listing
+var listingQueryKeys = []query.Param{
+	query.NewParam(`name`, typ.String, false),
+	query.NewParam(`nameRegexp`, typ.String, false),
+	query.NewPrefixParam(factPrefix, typ.String, false),
+}
+
+// listingDepth returns the number of levels between the entry appointed by the first lp parts of a key and
+// the level with the name given as the last part of that key, or zero if the key isn't a listing. The depth
+// is one for a listing of the entries directly beneath the entry and greater than one for a listing of the
+// entries of a lower level, e.g. "nodes" for all nodes across all realms.
+func (f *fileStorage) listingDepth(lp int, last string) int {
+	hns := f.levelNames()
+	for j := lp; j < len(hns); j++ {
+		if hns[j] == last {
+			return j - lp + 1
+		}
+	}
+	return 0
+}
+
+// eachEntry calls the given function with the data of each entry that is the given depth beneath the entry
+// appointed by the given parts. The function also receives the name of the entry and its key relative to the
+// parts, which is the name prefixed with the rel of the entry's parent. Entries without a data.yaml file are
+// skipped. It returns false and no error if the entry appointed by the parts doesn't exist.
+func (f *fileStorage) eachEntry(ctx context.Context, parts []string, depth int, rel string,
+	visit func(rel, name string, data dgo.Map) error) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	names, err := f.readChildNames(filepath.Join(f.dataDir, filepath.Join(parts...)))
+	if names == nil {
+		return false, err
+	}
+	for _, name := range names {
+		cp := append(parts[:len(parts):len(parts)], name)
+		data, err := f.readData(ctx, cp)
+		if err != nil {
+			return true, err
+		}
+		if data == nil {
+			continue
+		}
+		cr := name
+		if rel != `` {
+			cr = rel + `.` + name
+		}
+		if depth == 1 {
+			err = visit(cr, name, data)
+		} else {
+			_, err = f.eachEntry(ctx, cp, depth-1, cr, visit)
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// queryListing returns the entries that are the given depth beneath the entry appointed by the given parts
+// and that match the given query. The result maps the key of each entry, relative to the parts, to its
+// value. It returns nil if the entry appointed by the parts doesn't exist.
+func (f *fileStorage) queryListing(ctx context.Context, key string, parts []string, depth int, q dgo.Map) (query.Result, error) {
+	ef, err := newEntryFilter(key, q)
+	if err != nil {
+		return nil, err
+	}
+	qr := query.NewResult(true)
+	found, err := f.eachEntry(ctx, parts, depth, ``, func(rel, name string, data dgo.Map) error {
+		if !ef.matches(name, data) {
+			return nil
+		}
+		_, v, err := f.decrypt(key+`.`+rel, levelValue(data))
+		if err == nil {
+			qr.Add(vf.String(rel), v)
+		}
+		return err
+	})
+	if !found {
+		return nil, err
+	}
+	return qr, err
+}
+
+// entryFilter selects the entries of a listing
+type entryFilter struct {
+	name   string         // substring that the name must contain
+	nameRx *regexp.Regexp // regexp that the name must match
+	facts  []factFilter   // facts that the data must have
+}
+
+// factFilter selects entries with data that has a given value at a given path
+type factFilter struct {
+	path  []string
+	value string
+}
+
+// newEntryFilter creates a filter from the given query of the listing with the given key
+func newEntryFilter(key string, q dgo.Map) (*entryFilter, error) {
+	ef := &entryFilter{}
+	var err error
+	q.EachEntry(func(e dgo.MapEntry) {
+		k := e.Key().String()
+		v := e.Value().String()
+		switch {
+		case k == `name`:
+			ef.name = v
+		case k == `nameRegexp`:
+			var rx *regexp.Regexp
+			if rx, err = regexp.Compile(v); err != nil {
+				err = iapi.InvalidData{Key: key, Reason: fmt.Sprintf(`invalid nameRegexp: %s`, err.Error())}
+			}
+			ef.nameRx = rx
+		case strings.HasPrefix(k, factPrefix+`.`):
+			ef.facts = append(ef.facts, factFilter{path: strings.Split(k[len(factPrefix)+1:], `.`), value: v})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ef, nil
+}
+
+// matches returns true if an entry with the given name and data is selected by this filter
+func (ef *entryFilter) matches(name string, data dgo.Map) bool {
+	if !strings.Contains(name, ef.name) {
+		return false
+	}
+	if ef.nameRx != nil && !ef.nameRx.MatchString(name) {
+		return false
+	}
+	for _, ff := range ef.facts {
+		if !factMatches(dig(ff.path, data), ff.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// factMatches returns true if the given fact equals the given string, or if the fact is an array that
+// contains an element that equals the string. Encrypted facts never match.
+func factMatches(fact dgo.Value, value string) bool {
+	switch fact := fact.(type) {
+	case nil, dgo.Map:
+		return false
+	case dgo.Array:
+		return fact.Any(func(e dgo.Value) bool { return factMatches(e, value) })
+	case dgo.String:
+		return !pkcs7.IsEncrypted(fact.GoString()) && fact.GoString() == value
+	default:
+		return fact.String() == value
+	}
+}
@@ -0,0 +1,202 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/tf"
+	"github.com/puppetlabs/inventory/iapi"
+	"github.com/puppetlabs/inventory/yaml"
+)
+
+// schemaFile is the name of the file in the data directory that declares the levels of the hierarchy
+const schemaFile = `schema.yaml`
+
+// schemaKey is the key of the schema resource
+const schemaKey = `schema`
+
+// schemaFileType describes the contents of the schema file. The type of a level is the dgo type that the
+// data of each entry on that level must be an instance of.
+var schemaFileType = tf.ParseType(`{levels: []{name: string[1], type?: string[1]}}`)
+
+// A schema declares the name of each level of the hierarchy and the type of the data of its entries
+type schema struct {
+	names []string
+	types []dgo.Type // the type of each level, nil for levels that accept any data
+	data  dgo.Map    // the contents of the schema file
+}
+
+// schemaCache holds the schema as last read from the schema file
+type schemaCache struct {
+	lock   sync.Mutex
+	info   os.FileInfo
+	schema *schema
+}
+
+// loadSchema returns the schema of the storage or nil if the data directory has no schema file. The schema
+// is read again when the schema file has changed.
+func (f *fileStorage) loadSchema() (*schema, error) {
+	path := filepath.Join(f.dataDir, schemaFile)
+	c := &f.schemaCache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.info != nil && unchanged(c.info, path) {
+		return c.schema, nil
+	}
+	c.info = nil
+	c.schema = nil
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, iapi.IOError{Path: path, Err: err}
+	}
+	data, err := yaml.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.parseSchema(data)
+	if err != nil {
+		return nil, err
+	}
+	if !racy(info) {
+		c.info = info
+		c.schema = s
+	}
+	return s, nil
+}
+
+// parseSchema validates the given contents of the schema file and parses the types of its levels
+func (f *fileStorage) parseSchema(data dgo.Map) (s *schema, err error) {
+	if !schemaFileType.Instance(data) {
+		return nil, iapi.InvalidData{Key: schemaKey, Reason: tf.IllegalAssignment(schemaFileType, data).(error).Error()}
+	}
+	levels := data.Get(`levels`).(dgo.Array)
+	if len(f.hns) > 0 && len(f.hns) != levels.Len() {
+		return nil, iapi.InvalidData{Key: schemaKey,
+			Reason: fmt.Sprintf(`the schema declares %d levels but the storage has %d`, levels.Len(), len(f.hns))}
+	}
+	s = &schema{names: make([]string, levels.Len()), types: make([]dgo.Type, levels.Len()), data: data}
+	levels.EachWithIndex(func(lv dgo.Value, i int) {
+		if err != nil {
+			return
+		}
+		level := lv.(dgo.Map)
+		name := level.Get(`name`).String()
+		if len(f.hns) > 0 && f.hns[i] != name {
+			err = iapi.InvalidData{Key: schemaKey,
+				Reason: fmt.Sprintf(`level %d is named %q in the schema but %q in the storage`, i, name, f.hns[i])}
+			return
+		}
+		s.names[i] = name
+		if tv, ok := level.Get(`type`).(dgo.String); ok {
+			s.types[i], err = parseLevelType(name, tv.GoString())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseLevelType parses the type of the level with the given name
+func parseLevelType(name, content string) (t dgo.Type, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = iapi.InvalidData{Key: schemaKey, Reason: fmt.Sprintf(`unable to parse the type of level %q: %v`, name, r)}
+		}
+	}()
+	return tf.ParseType(content), nil
+}
+
+// levelNames returns the names of the levels of the hierarchy. The names given when the storage was created
+// take precedence over the names declared in the schema.
+func (f *fileStorage) levelNames() []string {
+	if len(f.hns) > 0 {
+		return f.hns
+	}
+	if s, err := f.loadSchema(); err == nil && s != nil {
+		return s.names
+	}
+	return nil
+}
+
+// validate returns an InvalidData error if the given data, which is stored under the given key, isn't an
+// instance of the type that the schema declares for its level.
+func (f *fileStorage) validate(key string, data dgo.Map) error {
+	s, err := f.loadSchema()
+	if err != nil || s == nil {
+		return err
+	}
+	level := strings.Count(key, `.`)
+	if level >= len(s.types) || s.types[level] == nil {
+		return nil
+	}
+	if reason := mismatch(s.types[level], data, ``); reason != `` {
+		return iapi.InvalidData{Key: key, Reason: reason}
+	}
+	return nil
+}
+
+// getSchema returns the schema resource, or the value found using the given keys to dig into it. It
+// returns nil if the data directory has no schema file.
+func (f *fileStorage) getSchema(keys []string) (dgo.Value, error) {
+	s, err := f.loadSchema()
+	if err != nil || s == nil {
+		return nil, err
+	}
+	return dig(keys, s.data), nil
+}
+
+// mismatch returns a description of why the given value isn't an instance of the given type, or an empty
+// string if it is. Struct maps are examined entry by entry so that the description appoints the offending
+// entry using the given dot separated path.
+func mismatch(t dgo.Type, v dgo.Value, path string) string {
+	if t.Instance(v) {
+		return ``
+	}
+	if st, ok := t.(dgo.StructMapType); ok {
+		if m, ok := v.(dgo.Map); ok {
+			reason := ``
+			st.Each(func(e dgo.StructMapEntry) {
+				if reason != `` {
+					return
+				}
+				k := e.Key().(dgo.ExactType).ExactValue()
+				if ev := m.Get(k); ev != nil {
+					reason = mismatch(e.Value().(dgo.Type), ev, joinPath(path, k))
+				} else if e.Required() {
+					reason = fmt.Sprintf(`missing required key %q`, joinPath(path, k))
+				}
+			})
+			if reason == `` && !st.Additional() {
+				m.EachKey(func(k dgo.Value) {
+					if reason == `` && st.Get(k) == nil {
+						reason = fmt.Sprintf(`unknown key %q`, joinPath(path, k))
+					}
+				})
+			}
+			if reason != `` {
+				return reason
+			}
+		}
+	}
+	reason := tf.IllegalAssignment(t, v).(error).Error()
+	if path != `` {
+		reason = path + `: ` + reason
+	}
+	return reason
+}
+
+// joinPath appends the given key to the given dot separated path
+func joinPath(path string, key dgo.Value) string {
+	if path == `` {
+		return key.String()
+	}
+	return path + `.` + key.String()
+}
@@ -0,0 +1,579 @@
+package file_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/lyraproj/dgo/dgo"
+	require "github.com/lyraproj/dgo/dgo_test"
+	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/change"
+	"github.com/puppetlabs/inventory/file"
+	"github.com/puppetlabs/inventory/iapi"
+	"github.com/puppetlabs/inventory/yaml"
+)
+
+var ctx = context.Background()
+
+func TestWatch_change(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	modc, w := watchStorage(newStorage(dir), t)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	createLevel(filepath.Join(dir, `realmA`, `nodeA`), vf.Map(`__value`, `nodeA`, `a`, `y`), t)
+	awaitMod(modc, func(mod *change.Modification) bool {
+		return mod.ResourceName == `realmA.nodeA` && mod.Type == change.Change && vf.Map(`a`, `y`).Equals(mod.Value)
+	}, t)
+}
+
+func TestWatch_newDirectory(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	modc, w := watchStorage(newStorage(dir), t)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	createLevel(filepath.Join(dir, `realmA`, `nodeB`), vf.Map(`__value`, `nodeB`, `b`, `x`), t)
+	awaitMod(modc, isMod(`realmA.nodeB`, change.Create), t)
+
+	// Directories that are added are watched too
+	createLevel(filepath.Join(dir, `realmA`, `nodeB`), vf.Map(`__value`, `nodeB`, `b`, `y`), t)
+	awaitMod(modc, func(mod *change.Modification) bool {
+		return mod.ResourceName == `realmA.nodeB` && mod.Type == change.Change && vf.Map(`b`, `y`).Equals(mod.Value)
+	}, t)
+
+	require.Ok(t, os.RemoveAll(filepath.Join(dir, `realmA`, `nodeB`)))
+	awaitMod(modc, isMod(`realmA.nodeB`, change.Delete), t)
+}
+
+func TestSet_replacedWhileLocked(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	nodeDir := filepath.Join(dir, `realmA`, `nodeA`)
+	path := filepath.Join(nodeDir, `data.yaml`)
+	l1 := flock.New(path)
+	require.Ok(t, l1.Lock())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := newStorage(dir).Set(ctx, `realmA.nodeA`, vf.Map(`b`, `x`))
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Another process replaces the file and locks the replacement before releasing the lock of the original
+	createLevel(nodeDir, vf.Map(`__value`, `nodeA`, `a`, `y`), t)
+	l2 := flock.New(path)
+	require.Ok(t, l2.Lock())
+	require.Ok(t, l1.Close())
+	select {
+	case err := <-done:
+		t.Fatalf(`set completed while the replacement was locked: %v`, err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.Ok(t, l2.Close())
+	require.Ok(t, <-done)
+
+	_, v, err := newStorage(dir).Get(ctx, `realmA.nodeA.facts`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(`a`, `y`, `b`, `x`), v)
+}
+
+func TestSet_concurrentCreate(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	wg := &sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			// Each goroutine uses its own storage so that the file locks serialize the changes
+			st := newStorage(dir)
+			for i := 0; i < 5; i++ {
+				node := fmt.Sprintf(`realmA.node%d`, i)
+				if _, err := st.Set(ctx, node, vf.Map(`__value`, node)); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := st.Set(ctx, node, vf.Map(fmt.Sprintf(`g%d`, g), g)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// No entry may be created twice and no change may be lost
+	for i := 0; i < 5; i++ {
+		_, v, err := newStorage(dir).Get(ctx, fmt.Sprintf(`realmA.node%d.facts`, i))
+		require.Ok(t, err)
+		require.Equal(t, 8, v.(dgo.Map).Len())
+	}
+}
+
+func TestSet_noTemporaryFiles(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	st := newStorage(dir)
+	_, err := st.Set(ctx, `realmA.nodeA`, vf.Map(`b`, `x`))
+	require.Ok(t, err)
+	_, err = st.Set(ctx, `realmA.nodeB`, vf.Map(`__value`, `nodeB`))
+	require.Ok(t, err)
+
+	for _, d := range []string{`nodeA`, `nodeB`} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, `realmA`, d))
+		require.Ok(t, err)
+		require.Equal(t, 1, len(files))
+		require.Equal(t, `data.yaml`, files[0].Name())
+	}
+}
+
+func TestDelete_value(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	createLevel(filepath.Join(dir, `realmA`, `nodeA`), vf.Map(`__value`, `nodeA`, `a`, `x`, `m`, vf.Map(`x`, 1)), t)
+	st := newStorage(dir)
+	mods, err := st.Delete(ctx, `realmA.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, 1, len(mods))
+	requireDeleted(findMod(mods, `realmA.nodeA`, change.Change, t), `a`, t)
+
+	// A deleted complex value is a resource of its own
+	mods, err = st.Delete(ctx, `realmA.nodeA.m`)
+	require.Ok(t, err)
+	require.Equal(t, 2, len(mods))
+	requireDeleted(findMod(mods, `realmA.nodeA`, change.Change, t), `m`, t)
+	findMod(mods, `realmA.nodeA.m`, change.Delete, t)
+
+	_, err = st.Delete(ctx, `realmA.nodeA.m`)
+	_, ok := err.(iapi.NotFound)
+	require.True(t, ok)
+}
+
+func TestDelete_entry(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	createLevel(filepath.Join(dir, `realmA`, `nodeA`), vf.Map(`__value`, `nodeA`, `m`, vf.Map(`x`, 1)), t)
+	createLevel(filepath.Join(dir, `realmA`, `nodeA`, `fact1`), vf.Map(`__value`, `fact1`), t)
+	st := newStorage(dir)
+	mods, err := st.Delete(ctx, `realmA.nodeA`)
+	require.Ok(t, err)
+
+	// The entry, its complex values, and the entries beneath it are deleted
+	findMod(mods, `realmA.nodeA`, change.Delete, t)
+	findMod(mods, `realmA.nodeA.m`, change.Delete, t)
+	findMod(mods, `realmA.nodeA.fact1`, change.Delete, t)
+
+	// The listings that contained the entries are changed
+	requireDeleted(findMod(mods, `realmA.nodes`, change.Change, t), `nodeA`, t)
+	requireDeleted(findMod(mods, `nodes`, change.Change, t), `realmA.nodeA`, t)
+	requireDeleted(findMod(mods, `realmA.nodeA.facts`, change.Change, t), `fact1`, t)
+
+	_, err = os.Stat(filepath.Join(dir, `realmA`, `nodeA`))
+	require.True(t, os.IsNotExist(err))
+	_, err = st.Delete(ctx, `realmA.nodeA`)
+	_, ok := err.(iapi.NotFound)
+	require.True(t, ok)
+}
+
+func TestGet_changedAfterCached(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, `realmA`, `nodeA`, `data.yaml`)
+	age(path, t)
+	st := newStorage(dir)
+	_, v, err := st.Get(ctx, `realmA.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, `x`, v)
+
+	// The file is changed in place and keeps its size
+	require.Ok(t, ioutil.WriteFile(path, []byte("__value: nodeA\na: y\n"), 0640))
+	_, v, err = st.Get(ctx, `realmA.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, `y`, v)
+}
+
+func TestGet_changedWithinRacyWindow(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, `realmA`, `nodeA`, `data.yaml`)
+	st := newStorage(dir)
+	_, v, err := st.Get(ctx, `realmA.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, `x`, v)
+
+	// A change made right after the read may leave the modification time unchanged
+	info, err := os.Stat(path)
+	require.Ok(t, err)
+	require.Ok(t, ioutil.WriteFile(path, []byte("__value: nodeA\na: y\n"), 0640))
+	require.Ok(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	_, v, err = st.Get(ctx, `realmA.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, `y`, v)
+}
+
+func TestGet_childAddedAfterCached(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	age(filepath.Join(dir, `realmA`), t)
+	age(filepath.Join(dir, `realmA`, `nodeA`, `data.yaml`), t)
+	st := newStorage(dir)
+	_, v, err := st.Get(ctx, `realmA.nodes`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(`nodeA`, `nodeA`), v)
+
+	createLevel(filepath.Join(dir, `realmA`, `nodeB`), vf.Map(`__value`, `nodeB`), t)
+	_, v, err = st.Get(ctx, `realmA.nodes`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(`nodeA`, `nodeA`, `nodeB`, `nodeB`), v)
+}
+
+func TestGet_changedWhileWatched(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	path := filepath.Join(dir, `realmA`, `nodeA`, `data.yaml`)
+	age(path, t)
+	st := newStorage(dir)
+	modc, w := watchStorage(st, t)
+	defer func() {
+		_ = w.Close()
+	}()
+	_, v, err := st.Get(ctx, `realmA.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, `x`, v)
+
+	// The cached entry is trusted until the watch forgets it
+	require.Ok(t, ioutil.WriteFile(path, []byte("__value: nodeA\na: y\n"), 0640))
+	awaitMod(modc, isMod(`realmA.nodeA`, change.Change), t)
+	_, v, err = st.Get(ctx, `realmA.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, `y`, v)
+}
+
+func TestSet_schemaMismatch(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	writeSchema(dir, t)
+	st := newStorage(dir)
+	tests := []struct {
+		model  dgo.Map
+		reason string
+	}{
+		{vf.Map(`os`, vf.Map(`family`, `RedHat`, `release`, `8`)),
+			`os.release: the string "8" cannot be assigned to a variable of type int`},
+		{vf.Map(`os`, vf.Map(`release`, 8)), `missing required key "os.family"`},
+		{vf.Map(`b`, `x`), `unknown key "b"`},
+	}
+	for _, tt := range tests {
+		_, err := st.Set(ctx, `realmA.nodeA`, tt.model)
+		id, ok := err.(iapi.InvalidData)
+		require.True(t, ok)
+		require.Equal(t, `realmA.nodeA`, id.Key)
+		require.Equal(t, tt.reason, id.Reason)
+	}
+
+	_, err := st.Set(ctx, `realmA.nodeA`, vf.Map(`os`, vf.Map(`family`, `RedHat`, `release`, 8)))
+	require.Ok(t, err)
+	_, v, err := st.Get(ctx, `realmA.nodeA.os`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(`family`, `RedHat`, `release`, 8), v)
+}
+
+func TestDelete_schemaMismatch(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	writeSchema(dir, t)
+	st := newStorage(dir)
+	_, err := st.Delete(ctx, `realmA.nodeA.__value`)
+	id, ok := err.(iapi.InvalidData)
+	require.True(t, ok)
+	require.Equal(t, `missing required key "__value"`, id.Reason)
+
+	// The rejected delete leaves the data unchanged while an optional key can be deleted
+	_, v, err := st.Get(ctx, `realmA.nodeA.__value`)
+	require.Ok(t, err)
+	require.Equal(t, `nodeA`, v)
+	_, err = st.Delete(ctx, `realmA.nodeA.a`)
+	require.Ok(t, err)
+}
+
+func TestGet_schema(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	writeSchema(dir, t)
+
+	// A storage created without level names uses the names of the schema
+	st := file.NewStorage(dir)
+	_, v, err := st.Get(ctx, `schema.levels.1.name`)
+	require.Ok(t, err)
+	require.Equal(t, `nodes`, v)
+	_, v, err = st.Get(ctx, `realmA.nodes`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(`nodeA`, `nodeA`), v)
+
+	_, err = st.Set(ctx, `schema`, vf.Map(`levels`, vf.Values()))
+	_, ok := err.(iapi.Conflict)
+	require.True(t, ok)
+}
+
+func TestGet_schemaLevelMismatch(t *testing.T) {
+	dir := testDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	writeSchema(dir, t)
+	_, _, err := file.NewStorage(dir, `realms`, `hosts`, `facts`).Get(ctx, `schema`)
+	id, ok := err.(iapi.InvalidData)
+	require.True(t, ok)
+	require.Equal(t, `level 1 is named "nodes" in the schema but "hosts" in the storage`, id.Reason)
+
+	_, _, err = file.NewStorage(dir, `realms`, `nodes`).Get(ctx, `schema`)
+	id, ok = err.(iapi.InvalidData)
+	require.True(t, ok)
+	require.Equal(t, `the schema declares 3 levels but the storage has 2`, id.Reason)
+}
+
+func TestQuery_filters(t *testing.T) {
+	dir := listingTestDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	st := newStorage(dir)
+	tests := []struct {
+		key    string
+		q      dgo.Map
+		result dgo.Map
+	}{
+		{`realmA.nodes`, vf.Map(`name`, `A`), vf.Map(`nodeA`, `nodeA`)},
+		{`nodes`, vf.Map(`nameRegexp`, `^node[BC]$`), vf.Map(`realmA.nodeB`, `nodeB`, `realmB.nodeC`, `nodeC`)},
+		{`nodes`, vf.Map(`fact.os.family`, `RedHat`), vf.Map(`realmA.nodeA`, `nodeA`, `realmB.nodeC`, `nodeC`)},
+		{`nodes`, vf.Map(`fact.os.family`, `RedHat`, `name`, `A`), vf.Map(`realmA.nodeA`, `nodeA`)},
+
+		// An array matches when one of its elements does
+		{`realmA.nodes`, vf.Map(`fact.roles`, `db`), vf.Map(`nodeA`, `nodeA`, `nodeB`, `nodeB`)},
+
+		// Maps and encrypted values never match
+		{`nodes`, vf.Map(`fact.os`, `{family: RedHat}`), vf.Map()},
+		{`nodes`, vf.Map(`fact.secret`, `ENC[PKCS7,MIIBeQYJKoZIhvcNAQcDoIIBajCCAWYCAQAx]`), vf.Map()},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.result, queryMap(st, tt.key, tt.q, t))
+	}
+
+	// A listing of an entry that doesn't exist has no result
+	_, qr, err := st.Query(ctx, `realmC.nodes`, vf.Map(`name`, `A`))
+	require.Ok(t, err)
+	require.Nil(t, qr)
+}
+
+func TestQuery_invalidRegexp(t *testing.T) {
+	dir := listingTestDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	_, _, err := newStorage(dir).Query(ctx, `nodes`, vf.Map(`nameRegexp`, `node(`))
+	id, ok := err.(iapi.InvalidData)
+	require.True(t, ok)
+	require.Equal(t, `nodes`, id.Key)
+	require.Match(t, `^invalid nameRegexp: `, id.Reason)
+}
+
+func TestGet_listing(t *testing.T) {
+	dir := listingTestDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	st := newStorage(dir)
+	_, v, err := st.Get(ctx, `nodes`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(`realmA.nodeA`, `nodeA`, `realmA.nodeB`, `nodeB`, `realmB.nodeC`, `nodeC`), v)
+
+	// Only listings are queryable
+	require.Equal(t, 3, len(st.QueryKeys(`realmA.nodes`)))
+	require.Equal(t, 0, len(st.QueryKeys(`realmA.nodeA`)))
+}
+
+func TestWatch_listing(t *testing.T) {
+	dir := listingTestDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	modc, w := watchStorage(newStorage(dir), t)
+	defer func() {
+		_ = w.Close()
+	}()
+
+	// The listings of all levels above the new entry are changed
+	createLevel(filepath.Join(dir, `realmB`, `nodeD`), vf.Map(`__value`, `nodeD`), t)
+	mods := awaitMod(modc, isMod(`realmB.nodeD`, change.Create), t)
+	require.Equal(t, vf.Map(`nodeD`, `nodeD`), findMod(mods, `realmB.nodes`, change.Change, t).Value)
+	require.Equal(t, vf.Map(`realmB.nodeD`, `nodeD`), findMod(mods, `nodes`, change.Change, t).Value)
+}
+
+// testDir returns a new temporary data directory with the entry realmA.nodeA
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	createLevel(filepath.Join(dir, `realmA`), vf.Map(`__value`, `realmA`), t)
+	createLevel(filepath.Join(dir, `realmA`, `nodeA`), vf.Map(`__value`, `nodeA`, `a`, `x`), t)
+	return dir
+}
+
+// listingTestDir returns a new temporary data directory with the nodes realmA.nodeA, realmA.nodeB, and realmB.nodeC
+func listingTestDir(t *testing.T) string {
+	t.Helper()
+	dir := testDir(t)
+	createLevel(filepath.Join(dir, `realmA`, `nodeA`), vf.Map(
+		`__value`, `nodeA`,
+		`os`, vf.Map(`family`, `RedHat`),
+		`roles`, vf.Values(`web`, `db`),
+		`secret`, `ENC[PKCS7,MIIBeQYJKoZIhvcNAQcDoIIBajCCAWYCAQAx]`), t)
+	createLevel(filepath.Join(dir, `realmA`, `nodeB`), vf.Map(
+		`__value`, `nodeB`,
+		`os`, vf.Map(`family`, `Debian`),
+		`roles`, vf.Values(`db`)), t)
+	createLevel(filepath.Join(dir, `realmB`), vf.Map(`__value`, `realmB`), t)
+	createLevel(filepath.Join(dir, `realmB`, `nodeC`), vf.Map(
+		`__value`, `nodeC`,
+		`os`, vf.Map(`family`, `RedHat`)), t)
+	return dir
+}
+
+// newStorage returns a storage for the given directory with the levels realms, nodes, and facts
+func newStorage(dir string) iapi.Storage {
+	return file.NewStorage(dir, `realms`, `nodes`, `facts`)
+}
+
+// writeSchema writes a schema file to the given data directory that declares the levels realms, nodes, and facts
+func writeSchema(dir string, t *testing.T) {
+	t.Helper()
+	require.Ok(t, yaml.Write(filepath.Join(dir, `schema.yaml`), vf.Map(`levels`, vf.Values(
+		vf.Map(`name`, `realms`, `type`, `{__value: string}`),
+		vf.Map(`name`, `nodes`, `type`, `{__value: string, a?: string, os?: {family: "RedHat"|"Debian", release?: int}}`),
+		vf.Map(`name`, `facts`)))))
+}
+
+// queryMap returns the result of the given query as a map
+func queryMap(st iapi.Storage, key string, q dgo.Map, t *testing.T) dgo.Map {
+	t.Helper()
+	_, qr, err := st.Query(ctx, key, q)
+	require.Ok(t, err)
+	m := vf.MutableMap()
+	qr.EachWithRefAndIndex(func(value, ref dgo.Value, _ int) {
+		m.Put(ref, value)
+	})
+	return m
+}
+
+// createLevel creates the given directory unless it exists and writes the given data to its data.yaml file
+func createLevel(dir string, data dgo.Map, t *testing.T) {
+	t.Helper()
+	require.Ok(t, os.MkdirAll(dir, 0750))
+	require.Ok(t, yaml.Write(filepath.Join(dir, `data.yaml`), data))
+}
+
+// age sets the modification time of the given file or directory to an hour ago so that it is cached when read
+func age(path string, t *testing.T) {
+	t.Helper()
+	old := time.Now().Add(-time.Hour)
+	require.Ok(t, os.Chtimes(path, old, old))
+}
+
+// watchStorage starts watching the given storage and gives the watch time to perform its initial scan
+func watchStorage(st iapi.Storage, t *testing.T) (chan []*change.Modification, io.Closer) {
+	t.Helper()
+	modc := make(chan []*change.Modification, 10)
+	w, err := st.(iapi.Watchable).Watch(ctx, func(mods []*change.Modification) { modc <- mods })
+	require.Ok(t, err)
+	time.Sleep(200 * time.Millisecond)
+	return modc, w
+}
+
+// awaitMod waits for a modification that satisfies the given predicate to be passed to the watch and returns
+// the modifications that were passed together with it
+func awaitMod(modc chan []*change.Modification, pred func(*change.Modification) bool, t *testing.T) []*change.Modification {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case mods := <-modc:
+			for _, mod := range mods {
+				if pred(mod) {
+					return mods
+				}
+			}
+		case <-timeout:
+			t.Fatal(`the expected modification was not detected`)
+			return nil
+		}
+	}
+}
+
+func isMod(key string, mt change.ModType) func(*change.Modification) bool {
+	return func(mod *change.Modification) bool {
+		return mod.ResourceName == key && mod.Type == mt
+	}
+}
+
+// findMod returns the modification of the given resource with the given type
+func findMod(mods []*change.Modification, key string, mt change.ModType, t *testing.T) *change.Modification {
+	t.Helper()
+	for _, mod := range mods {
+		if isMod(key, mt)(mod) {
+			return mod
+		}
+	}
+	t.Fatalf(`no modification of type %d for %s`, mt, key)
+	return nil
+}
+
+// requireDeleted checks that the given change modification deletes exactly the given property
+func requireDeleted(mod *change.Modification, key string, t *testing.T) {
+	t.Helper()
+	props, ok := mod.Value.(dgo.Map)
+	require.True(t, ok)
+	require.Equal(t, 1, props.Len())
+	require.True(t, change.Deleted == props.Get(key))
+}
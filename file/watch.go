@@ -0,0 +1,375 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/change"
+	"github.com/sirupsen/logrus"
+)
+
+const dataFile = `data.yaml`
+
+// watchDelay is the time that the watch waits for more events before it acts on the events that it has
+// received. Editors and tools that save files typically cause several events in quick succession.
+const watchDelay = 100 * time.Millisecond
+
+// watch is the io.Closer returned from Watch
+type watch struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close stops the watch and waits for it to finish
+func (w *watch) Close() error {
+	w.cancel()
+	<-w.done
+	return nil
+}
+
+// Watch starts watching all directories beneath the data directory for changes. Changes to data.yaml files
+// are compared to their previous contents and the resulting modifications are passed to onModify. Directories
+// that are added are watched and reported as new hierarchy entries. Changes made using the methods of the
+// storage are not reported since those methods return the modifications themselves. The watch continues
+// until the given context is done or the returned io.Closer is closed.
+func (f *fileStorage) Watch(ctx context.Context, onModify func([]*change.Modification)) (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watchTree(watcher, f.dataDir); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	f.lock.Lock()
+	if f.levels != nil {
+		f.lock.Unlock()
+		_ = watcher.Close()
+		return nil, errors.New(`the storage is already watched`)
+	}
+	f.levels = make(map[string]dgo.Map)
+	f.cache.trust(true)
+	f.lock.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watch{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		defer func() {
+			_ = watcher.Close()
+			f.lock.Lock()
+			f.levels = nil
+			f.schemaData = nil
+			f.cache.trust(false)
+			f.lock.Unlock()
+		}()
+
+		// The initial scan establishes what to compare with. It is performed here since it might have to
+		// wait for file locks.
+		f.lock.Lock()
+		f.scan(ctx, f.dataDir, true)
+		f.scanSchema(nil)
+		f.lock.Unlock()
+		f.watchFunc(ctx, watcher, onModify)
+	}()
+	return w, nil
+}
+
+func (f *fileStorage) watchFunc(ctx context.Context, watcher *fsnotify.Watcher, onModify func([]*change.Modification)) {
+	pending := make(map[string]fsnotify.Op)
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			pending[event.Name] |= event.Op
+			delay = time.After(watchDelay)
+		case <-delay:
+			delay = nil
+			names := make([]string, 0, len(pending))
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			var mods []*change.Modification
+			for _, name := range names {
+				mods = append(mods, f.handleEvent(ctx, watcher, fsnotify.Event{Name: name, Op: pending[name]})...)
+			}
+			pending = make(map[string]fsnotify.Op)
+			if len(mods) > 0 {
+				onModify(mods)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("error watching %s: %s", f.dataDir, err.Error())
+
+			// Events might have been lost, so directories that were added are watched, the cached entries are
+			// forgotten, and everything is scanned again
+			if err = watchTree(watcher, f.dataDir); err != nil {
+				logrus.Errorf("unable to watch %s: %s", f.dataDir, err.Error())
+			}
+			f.cache.forget(f.dataDir, true)
+			mods := append(f.rescanSchema(), f.rescan(ctx, f.dataDir, true)...)
+			if len(mods) > 0 && ctx.Err() == nil {
+				onModify(mods)
+			}
+		}
+	}
+}
+
+// handleEvent rescans the levels affected by the given event and returns the resulting modifications. The
+// operation of the event is the union of the operations of all events for the same name that were received
+// since the last time the events were handled.
+func (f *fileStorage) handleEvent(ctx context.Context, watcher *fsnotify.Watcher, event fsnotify.Event) []*change.Modification {
+	name := event.Name
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, `.`+dataFile+`.`) || base == createLockFile {
+		// Temporary file that replaces a data.yaml file when it is written, or the lock held while creating
+		// an entry
+		return nil
+	}
+	if base == dataFile {
+		if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+			return f.rescan(ctx, filepath.Dir(name), false)
+		}
+		return nil
+	}
+	if name == filepath.Join(f.dataDir, schemaFile) {
+		return f.rescanSchema()
+	}
+	if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return nil
+	}
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		if err = watchTree(watcher, name); err != nil {
+			logrus.Errorf("unable to watch directory %s: %s", name, err.Error())
+		}
+	}
+	return f.rescan(ctx, name, true)
+}
+
+// watchTree adds the given directory and all directories beneath it to the watcher
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// rescan rescans the given directory, and all directories beneath it if recursive is true, and returns the
+// modifications that are found. Nothing is returned unless the storage is watched.
+func (f *fileStorage) rescan(ctx context.Context, dir string, recursive bool) []*change.Modification {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.levels == nil {
+		return nil
+	}
+	return f.scan(ctx, dir, recursive)
+}
+
+// scan reads the data of the level of the given directory, and of all levels beneath it if recursive is
+// true, compares it to the previously read data, and returns the modifications. A level that cannot be read
+// is logged and retains its previous data. The caller must hold the lock of the storage.
+func (f *fileStorage) scan(ctx context.Context, dir string, recursive bool) []*change.Modification {
+	dirs := []string{dir}
+	if recursive {
+		dirs = dirs[:0]
+		_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				dirs = append(dirs, path)
+			}
+			return nil
+		})
+	}
+
+	levels := make(map[string]dgo.Map, len(dirs))
+	for _, d := range dirs {
+		levels[d] = nil
+	}
+	for d := range f.levels {
+		if d == dir || recursive && strings.HasPrefix(d, dir+string(filepath.Separator)) {
+			levels[d] = nil
+		}
+	}
+
+	paths := make([]string, 0, len(levels))
+	for d := range levels {
+		paths = append(paths, d)
+	}
+	sort.Strings(paths)
+
+	var mods []*change.Modification
+	for _, d := range paths {
+		parts := f.partsOf(d)
+		if parts == nil {
+			continue
+		}
+		old := f.levels[d]
+		f.cache.forget(d, false)
+		data, err := f.readLevel(ctx, parts)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.Errorf("unable to read %s: %s", filepath.Join(d, dataFile), err.Error())
+			}
+			continue
+		}
+		if data == nil {
+			delete(f.levels, d)
+		} else {
+			f.levels[d] = data
+		}
+		mods = f.levelMods(parts, old, data, mods)
+	}
+	return mods
+}
+
+// rescanSchema reads the schema and returns the modifications of the schema resource. Nothing is returned
+// unless the storage is watched.
+func (f *fileStorage) rescanSchema() []*change.Modification {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.levels == nil {
+		return nil
+	}
+	return f.scanSchema(nil)
+}
+
+// scanSchema reads the schema, compares it to the previously read schema, and appends the modifications of
+// the schema resource to the given slice. A schema that cannot be read is logged and the previous schema is
+// retained. The caller must hold the lock of the storage.
+func (f *fileStorage) scanSchema(mods []*change.Modification) []*change.Modification {
+	data, err := f.getSchema(nil)
+	if err != nil {
+		logrus.Errorf("unable to read %s: %s", filepath.Join(f.dataDir, schemaFile), err.Error())
+		return mods
+	}
+	old := f.schemaData
+	f.schemaData = data
+	switch {
+	case old == nil && data == nil:
+	case old == nil:
+		mods = append(mods, &change.Modification{ResourceName: schemaKey, Type: change.Create, Value: data})
+	case data == nil:
+		mods = append(mods, &change.Modification{ResourceName: schemaKey, Type: change.Delete})
+	default:
+		mods = change.Map(schemaKey, old.(dgo.Map).Copy(false), data.(dgo.Map), mods)
+	}
+	return mods
+}
+
+// synced forgets the cached data of the levels at and beneath the given directory after a change made by the
+// storage itself and updates their data so that the change isn't reported by the watch. The caller must hold
+// the lock of the storage.
+func (f *fileStorage) synced(ctx context.Context, dir string) {
+	f.cache.forget(dir, true)
+	if f.levels != nil {
+		f.scan(ctx, dir, true)
+	}
+}
+
+// readLevel reads and decrypts the data of the level appointed by the given parts. It returns nil and no
+// error if the level has no data.yaml file.
+func (f *fileStorage) readLevel(ctx context.Context, parts []string) (dgo.Map, error) {
+	// Check existence first since obtaining the lock would create the file
+	if _, err := os.Stat(filepath.Join(f.dataDir, filepath.Join(parts...), dataFile)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	data, err := f.readData(ctx, parts)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	_, dv, err := f.decrypt(strings.Join(parts, `.`), data)
+	if err != nil {
+		return nil, err
+	}
+	return dv.(dgo.Map), nil
+}
+
+// levelValue returns the value of a level with the given data
+func levelValue(data dgo.Map) dgo.Value {
+	if v := data.Get(valueKey); v != nil {
+		return v
+	}
+	return vf.Nil
+}
+
+// partsOf returns the key parts of the level of the given directory or nil if the directory is the data
+// directory or isn't beneath it.
+func (f *fileStorage) partsOf(dir string) []string {
+	rel, err := filepath.Rel(f.dataDir, dir)
+	if err != nil || rel == `.` || strings.HasPrefix(rel, `..`) {
+		return nil
+	}
+	return strings.Split(rel, string(filepath.Separator))
+}
+
+// levelMods appends the modifications needed to change the data of the level appointed by parts from old
+// to data. Both old and data may be nil. A level that disappears is deleted together with its complex values.
+// The listing of the parent level, and the listings of the same level that span several parents, are changed
+// when the level appears, disappears, or changes its value.
+func (f *fileStorage) levelMods(parts []string, old, data dgo.Map, mods []*change.Modification) []*change.Modification {
+	key := strings.Join(parts, `.`)
+	var lv dgo.Value
+	switch {
+	case old == nil && data == nil:
+		return mods
+	case old == nil:
+		mods = append(mods, &change.Modification{ResourceName: key, Type: change.Create, Value: data})
+		lv = levelValue(data)
+	case data == nil:
+		old.EachEntry(func(e dgo.MapEntry) {
+			if k := e.Key().String(); k != valueKey && change.IsComplex(e.Value()) {
+				mods = append(mods, &change.Modification{ResourceName: key + `.` + k, Type: change.Delete})
+			}
+		})
+		mods = append(mods, &change.Modification{ResourceName: key, Type: change.Delete})
+		lv = change.Deleted
+	default:
+		mods = change.Map(key, old.Copy(false), data, mods)
+		lv = levelValue(data)
+		if lv.Equals(levelValue(old)) {
+			return mods
+		}
+	}
+	lp := len(parts) - 1
+	hns := f.levelNames()
+	if lp >= len(hns) {
+		return mods
+	}
+
+	// The listing of the parent comes first, followed by the listings that span more and more levels
+	for k := lp; k >= 0; k-- {
+		lk := hns[lp]
+		if k > 0 {
+			lk = strings.Join(parts[:k], `.`) + `.` + lk
+		}
+		changed := vf.MutableMap()
+		changed.Put(strings.Join(parts[k:], `.`), lv)
+		mods = append(mods, &change.Modification{ResourceName: lk, Type: change.Change, Value: changed})
+	}
+	return mods
+}
@@ -1,7 +1,9 @@
 package iapi
 
 import (
+	"context"
 	"fmt"
+	"io"
 
 	"github.com/puppetlabs/inventory/change"
 
@@ -18,6 +20,50 @@ func (n NotFound) Error() string {
 	return fmt.Sprintf(`key %q not found`, string(n))
 }
 
+// InvalidData is an error implementation used by Storage to provide information about a value that is
+// invalid, such as a model that doesn't conform to what the storage expects at the given key.
+type InvalidData struct {
+	Key    string
+	Reason string
+}
+
+func (e InvalidData) Error() string {
+	if e.Key == `` {
+		return e.Reason
+	}
+	return fmt.Sprintf(`invalid data for key %q: %s`, e.Key, e.Reason)
+}
+
+// Conflict is an error implementation used by Storage to provide information about a change that
+// cannot be made because it conflicts with the current state of the storage.
+type Conflict struct {
+	Key    string
+	Reason string
+}
+
+func (e Conflict) Error() string {
+	if e.Key == `` {
+		return e.Reason
+	}
+	return fmt.Sprintf(`conflict for key %q: %s`, e.Key, e.Reason)
+}
+
+// IOError is an error implementation used by Storage to provide information about a failure to read or
+// write the file at the given path.
+type IOError struct {
+	Path string
+	Err  error
+}
+
+func (e IOError) Error() string {
+	return fmt.Sprintf(`%s: %s`, e.Path, e.Err.Error())
+}
+
+// Unwrap returns the error that caused this error
+func (e IOError) Unwrap() error {
+	return e.Err
+}
+
 // Resource is implemented by storage entities that can be uniquely identified within
 // the storage using an resource ID.
 type Resource interface {
@@ -33,19 +79,23 @@ type Resource interface {
 // A Storage is some kind of database capable of storing a hierarchy of arbitrary depth. An item
 // is associated with a dot delimited key. Elements in arrays are access using numeric segments in
 // such keys.
+//
+// Methods that take a context.Context abort and return the error of the context when the context is
+// canceled or its deadline is exceeded before the operation completes.
 type Storage interface {
-	// Delete will make an attempt to delete the value with the given key from the storage. It
-	// a slice of modifications and true on success and false when no such key was found.
-	Delete(key string) ([]*change.Modification, bool)
+	// Delete will make an attempt to delete the value with the given key from the storage. It returns
+	// a slice of modifications on success and a NotFound error when no such key was found.
+	Delete(ctx context.Context, key string) ([]*change.Modification, error)
 
 	// Get finds a value using a dot separated key. It returns a slice of modifications that has been
 	// made since the storage was last accessed together with the value or nil if no value is found.
-	Get(key string) ([]*change.Modification, dgo.Value)
+	// An error is returned when the storage is unable to read or interpret its data.
+	Get(ctx context.Context, key string) ([]*change.Modification, dgo.Value, error)
 
 	// Query finds a value using the dot separate key and a map of query values It returns a slice of
 	// modifications that has been made since the storage was last accessed together the result of
-	// the query.
-	Query(key string, query dgo.Map) ([]*change.Modification, query.Result)
+	// the query. An error is returned when the storage is unable to read or interpret its data.
+	Query(ctx context.Context, key string, query dgo.Map) ([]*change.Modification, query.Result, error)
 
 	// QueryKeys returns the set of keys that can be used to query this storage at the given
 	// key in a predictable order.
@@ -57,5 +107,46 @@ type Storage interface {
 	//
 	// An attempt to store a model using a non existent key will result in a NotFound
 	// error.
-	Set(key string, model dgo.Map) ([]*change.Modification, error)
+	Set(ctx context.Context, key string, model dgo.Map) ([]*change.Modification, error)
+}
+
+// A Callable is a Storage that can perform methods other than set and delete on its resources.
+type Callable interface {
+	Storage
+
+	// Methods returns the names of the methods that can be called on the resources of this storage.
+	Methods() []string
+
+	// Call performs the method with the given name on the resource appointed by the given key using
+	// the given parameters. It returns a slice of modifications and the result of the call. The result
+	// may be nil.
+	//
+	// An attempt to call a method on a non existent key will result in a NotFound error.
+	Call(ctx context.Context, key, method string, params dgo.Map) ([]*change.Modification, dgo.Value, error)
+}
+
+// A Watchable is a Storage that detects changes that are made to its data by other means than its own
+// methods, e.g. files that are edited by hand.
+type Watchable interface {
+	Storage
+
+	// Watch starts watching for changes. The modifications that result from a change are passed to
+	// onModify. The watch continues until the given context is done or the returned io.Closer is
+	// closed. Close waits for the watch to finish so that onModify isn't called after it returns.
+	Watch(ctx context.Context, onModify func([]*change.Modification)) (io.Closer, error)
+}
+
+// A RealmLocator is a Storage that can tell what realm a key belongs to.
+type RealmLocator interface {
+	// RealmOf returns the name of the realm that the resource appointed by the given key belongs to, or an
+	// empty string if the resource doesn't belong to a specific realm.
+	RealmOf(key string) string
+}
+
+// An EntityLocator is a Storage that can tell where the part of a key that appoints an entity ends and the
+// part that appoints data of that entity begins.
+type EntityLocator interface {
+	// EntitySegments returns the number of leading segments of the given key that appoint an entity, or a
+	// listing of entities. The remaining segments of the key are keys in the data of the entity.
+	EntitySegments(key string) int
 }
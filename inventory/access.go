@@ -0,0 +1,86 @@
+package inventory
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/jirenius/go-res"
+	"github.com/puppetlabs/inventory/iapi"
+)
+
+// Permission determines what a client may do with a resource
+type Permission int
+
+const (
+	// NoAccess denies all access to the resource
+	NoAccess = Permission(iota)
+
+	// ReadAccess permits get of the resource
+	ReadAccess
+
+	// CallAccess permits get of the resource and calls to all of its methods except reveal
+	CallAccess
+
+	// RevealAccess permits get of the resource and calls to all of its methods
+	RevealAccess
+)
+
+// An Authorizer determines the permission that a client has on the resource appointed by the given key. The
+// token is the Resgate access token of the client. It is empty when the client has no token. The realm is the
+// name of the realm that the resource belongs to. It is empty when the resource doesn't belong to a specific
+// realm.
+type Authorizer interface {
+	Permission(token json.RawMessage, key, realm string) Permission
+}
+
+// Authorize installs the given Authorizer. Access requests are answered using the permission that it
+// determines, and set, delete, and method calls are rejected unless the permission allows them.
+func Authorize(a Authorizer) Option {
+	return func(s *Service) {
+		s.authorizer = a
+		s.access = s.authorizedAccess
+	}
+}
+
+// authorizedAccess responds to the access request using the permission determined by the authorizer
+func (s *Service) authorizedAccess(r res.AccessRequest) {
+	key := r.ResourceName()
+	if !strings.HasPrefix(key, prefix) {
+		r.AccessDenied()
+		return
+	}
+	switch s.permission(r.RawToken(), key[prefixLen:]) {
+	case ReadAccess:
+		r.Access(true, ``)
+	case CallAccess:
+		r.Access(true, strings.Join(s.methods, `,`))
+	case RevealAccess:
+		r.AccessGranted()
+	default:
+		r.AccessDenied()
+	}
+}
+
+// permitted returns true unless an authorizer has been installed that denies the client of the given
+// request the required permission on the resource appointed by the given key. An access denied error
+// is sent when false is returned.
+func (s *Service) permitted(r res.CallRequest, key string, required Permission) bool {
+	if s.authorizer == nil || s.permission(r.RawToken(), key) >= required {
+		return true
+	}
+	r.Error(res.ErrAccessDenied)
+	return false
+}
+
+func (s *Service) permission(token json.RawMessage, key string) Permission {
+	return s.authorizer.Permission(token, key, s.realmOf(key))
+}
+
+// realmOf returns the realm that the resource appointed by the given key belongs to. The first segment
+// of the key is used unless the storage is a RealmLocator.
+func (s *Service) realmOf(key string) string {
+	if rl, ok := s.storage.(iapi.RealmLocator); ok {
+		return rl.RealmOf(key)
+	}
+	return strings.SplitN(key, `.`, 2)[0]
+}
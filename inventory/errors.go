@@ -0,0 +1,123 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/jirenius/go-res"
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/streamer"
+	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/iapi"
+	"github.com/sirupsen/logrus"
+)
+
+// CodeConflict is the code of the error that is sent when a request conflicts with the current state of
+// the storage, e.g. an attempt to add a group that already exists.
+const CodeConflict = ServiceName + `.conflict`
+
+// errorResponder is implemented by all requests that can respond with an error
+type errorResponder interface {
+	Error(err *res.Error)
+}
+
+// sendError responds with the Resgate error that corresponds to the given error. Internal errors are logged.
+func sendError(r errorResponder, err error) {
+	re := toResError(err)
+	if re.Code == res.CodeInternalError {
+		logrus.Errorf(`internal error: %s`, err.Error())
+	}
+	r.Error(re)
+}
+
+// sendReadError responds with the Resgate error that corresponds to an error that occurred when reading
+// from the storage. Only a NotFound error is attributed to the request. All other errors, including invalid
+// data, are problems with the storage and are logged and sent as internal errors.
+func sendReadError(r errorResponder, err error) {
+	if _, ok := err.(iapi.NotFound); ok {
+		r.Error(res.ErrNotFound)
+		return
+	}
+	if isContextError(err) {
+		r.Error(res.ErrTimeout)
+		return
+	}
+	logrus.Errorf(`internal error: %s`, err.Error())
+	r.Error(res.ErrInternalError)
+}
+
+// sendQueryError responds with the Resgate error that corresponds to an error that occurred when querying
+// the storage. Invalid data is caused by the query, e.g. an invalid regular expression, and is sent as an
+// invalid query. All other errors are handled like read errors.
+func sendQueryError(r errorResponder, err error) {
+	if _, ok := err.(iapi.InvalidData); ok {
+		r.Error(&res.Error{Code: res.CodeInvalidQuery, Message: err.Error()})
+		return
+	}
+	sendReadError(r, err)
+}
+
+// toResError translates the given error into a Resgate error. Errors that don't originate from a known
+// condition are translated into an internal error with a generic message.
+func toResError(err error) *res.Error {
+	if isContextError(err) {
+		return res.ErrTimeout
+	}
+	switch err := err.(type) {
+	case *res.Error:
+		return err
+	case iapi.NotFound:
+		return &res.Error{Code: res.CodeNotFound, Message: err.Error()}
+	case iapi.InvalidData:
+		return &res.Error{Code: res.CodeInvalidParams, Message: err.Error()}
+	case iapi.Conflict:
+		return &res.Error{Code: CodeConflict, Message: err.Error()}
+	default:
+		// The message of an internal error, e.g. one that contains the path of a file on the server, is
+		// only logged
+		return res.ErrInternalError
+	}
+}
+
+// isContextError returns true if the given error, or an error that it wraps, is the error of a context that
+// was canceled or whose deadline was exceeded before the storage operation completed
+func isContextError(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// recoverRequest recovers a panic that occurred while handling a request and responds with the
+// corresponding error. The stack trace of panics that don't originate from a known condition is logged.
+func recoverRequest(r errorResponder) {
+	if pe := recover(); pe != nil {
+		err, ok := pe.(error)
+		if !ok {
+			err = fmt.Errorf(`%v`, pe)
+		}
+		re := toResError(err)
+		if re.Code == res.CodeInternalError {
+			logrus.Errorf("internal error: %s\n%s", err.Error(), debug.Stack())
+		}
+		r.Error(re)
+	}
+}
+
+// parseParams returns the parameters of the given request as a map. An empty map is returned when the
+// request has no parameters.
+func parseParams(r res.CallRequest) (params dgo.Map, err error) {
+	raw := r.RawParams()
+	if len(raw) == 0 {
+		return vf.Map(), nil
+	}
+	defer func() {
+		if pe := recover(); pe != nil {
+			err = iapi.InvalidData{Reason: fmt.Sprintf(`unable to parse parameters: %v`, pe)}
+		}
+	}()
+	var ok bool
+	if params, ok = streamer.UnmarshalJSON(raw, nil).(dgo.Map); !ok {
+		err = iapi.InvalidData{Reason: `parameters must be an object`}
+	}
+	return
+}
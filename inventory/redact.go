@@ -0,0 +1,209 @@
+package inventory
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/iapi"
+)
+
+// redacted is the value that replaces sensitive values in responses and events
+const redacted = `[redacted]`
+
+// explainKey is the segment of a key that appoints an explanation of where the data of a target was declared.
+// Each entry of an explanation is a map that holds the explained key, its value, and the values it overrides.
+const explainKey = `explain`
+
+var keyV = vf.String(`key`)
+var overridesV = vf.String(`overrides`)
+var valueV = vf.String(`value`)
+
+// DefaultSensitiveKeys are the patterns used when no SensitiveKeys option is given
+var DefaultSensitiveKeys = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)password`),
+	regexp.MustCompile(`(?i)private[-_]?key`),
+	regexp.MustCompile(`(?i)token`),
+}
+
+// isSensitiveKey returns true if the given key matches one of the sensitive key patterns
+func (s *Service) isSensitiveKey(key string) bool {
+	for _, p := range s.sensitiveKeys {
+		if p.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSensitiveData returns true if the given dot separated data key, or any of its segments, matches one of the
+// sensitive key patterns
+func (s *Service) isSensitiveData(key string) bool {
+	if s.isSensitiveKey(key) {
+		return true
+	}
+	for _, part := range strings.Split(key, `.`) {
+		if s.isSensitiveKey(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSensitivePath returns true if any of the segments of the given resource name that are keys in the data of an
+// entity matches one of the sensitive key patterns. Segments that appoint the entity, such as the name of a realm
+// or a node, are never considered sensitive.
+func (s *Service) isSensitivePath(rid string) bool {
+	for _, part := range s.dataKeys(storageKey(rid)) {
+		if s.isSensitiveKey(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// dataKeys returns the segments of the given storage key that are keys in the data of an entity. The first segment
+// is assumed to appoint the entity unless the storage is an EntityLocator.
+func (s *Service) dataKeys(key string) []string {
+	parts := strings.Split(key, `.`)
+	n := 1
+	if el, ok := s.storage.(iapi.EntityLocator); ok {
+		n = el.EntitySegments(key)
+	}
+	if n >= len(parts) {
+		return nil
+	}
+	return parts[n:]
+}
+
+// storageKey returns the key in the storage of the resource with the given name
+func storageKey(rid string) string {
+	if strings.HasPrefix(rid, valuePrefix) {
+		return rid[valuePrefixLen:]
+	}
+	return strings.TrimPrefix(rid, prefix)
+}
+
+// redactAt redacts the given value, found under the given resource name. The value is redacted in its
+// entirety when the resource name contains a sensitive key.
+func (s *Service) redactAt(key string, v dgo.Value) dgo.Value {
+	if s.isSensitivePath(key) {
+		return vf.String(redacted)
+	}
+	return s.redact(v)
+}
+
+// redact returns the given value with all sensitive values, and all values of map entries with sensitive keys,
+// replaced by the redacted string. The value and the overridden values of an explanation of a sensitive key are
+// redacted too. Maps and Arrays that contain nothing to redact are returned as is. The contents of resources are
+// not redacted since they are represented by references.
+func (s *Service) redact(v dgo.Value) dgo.Value {
+	if !s.needsRedaction(v) {
+		return v
+	}
+	switch v := v.(type) {
+	case dgo.Map:
+		if s.explainsSensitiveKey(v) {
+			return v.Map(func(e dgo.MapEntry) interface{} {
+				switch {
+				case valueV.Equals(e.Key()):
+					return redacted
+				case overridesV.Equals(e.Key()):
+					return redactValues(e.Value())
+				}
+				return s.redact(e.Value())
+			})
+		}
+		return v.Map(func(e dgo.MapEntry) interface{} {
+			if s.isSensitiveKey(e.Key().String()) {
+				return redacted
+			}
+			return s.redact(e.Value())
+		})
+	case dgo.Array:
+		return v.Map(func(e dgo.Value) interface{} { return s.redact(e) })
+	default:
+		return vf.String(redacted)
+	}
+}
+
+func (s *Service) needsRedaction(v dgo.Value) bool {
+	switch v := v.(type) {
+	case dgo.Sensitive:
+		return true
+	case iapi.Resource:
+	case dgo.Map:
+		return s.explainsSensitiveKey(v) ||
+			v.Any(func(e dgo.MapEntry) bool { return s.isSensitiveKey(e.Key().String()) || s.needsRedaction(e.Value()) })
+	case dgo.Array:
+		return v.Any(s.needsRedaction)
+	}
+	return false
+}
+
+// explainsSensitiveKey returns true if the given map is an entry of an explanation, i.e. a map with a "key" and a
+// "value", and the key that it explains is sensitive
+func (s *Service) explainsSensitiveKey(m dgo.Map) bool {
+	k, ok := m.Get(keyV).(dgo.String)
+	return ok && m.ContainsKey(valueV) && s.isSensitiveData(k.GoString())
+}
+
+// redactExplanation redacts the given value, read using the given storage key, when the key appoints the value
+// or the overrides of an entry of an explanation and that entry explains a sensitive key. Such resources don't
+// contain the key that the entry explains, so it is read from the storage.
+func (s *Service) redactExplanation(ctx context.Context, key string, v dgo.Value) dgo.Value {
+	parts := strings.Split(key, `.`)
+	ei := -1
+	for i, part := range parts {
+		if part == explainKey {
+			ei = i + 3 // explain.<section>.<index>
+			break
+		}
+	}
+	if ei < 0 || ei >= len(parts) || !(parts[ei] == valueV.GoString() || parts[ei] == overridesV.GoString()) {
+		return v
+	}
+	mods, ek, err := s.storage.Get(ctx, strings.Join(append(parts[:ei:ei], keyV.GoString()), `.`))
+	s.Modifications(mods)
+	if err != nil || ek == nil || !s.isSensitiveData(ek.String()) {
+		return v
+	}
+	if parts[ei] == valueV.GoString() || parts[len(parts)-1] == valueV.GoString() {
+		return vf.String(redacted)
+	}
+	return redactValues(v)
+}
+
+// redactValues returns the given map, or array of maps, with the value of each "value" entry replaced by the
+// redacted string
+func redactValues(v dgo.Value) dgo.Value {
+	switch v := v.(type) {
+	case dgo.Map:
+		return v.Map(func(e dgo.MapEntry) interface{} {
+			if valueV.Equals(e.Key()) {
+				return redacted
+			}
+			return e.Value()
+		})
+	case dgo.Array:
+		return v.Map(func(e dgo.Value) interface{} { return redactValues(e) })
+	}
+	return v
+}
+
+// unwrapSensitive returns the given value with all sensitive values unwrapped
+func unwrapSensitive(v dgo.Value) dgo.Value {
+	switch v := v.(type) {
+	case dgo.Sensitive:
+		return unwrapSensitive(v.Unwrap())
+	case iapi.Resource:
+		return unwrapSensitive(v.DataMap())
+	case dgo.Map:
+		return v.Map(func(e dgo.MapEntry) interface{} { return unwrapSensitive(e.Value()) })
+	case dgo.Array:
+		return v.Map(func(e dgo.Value) interface{} { return unwrapSensitive(e) })
+	}
+	return v
+}
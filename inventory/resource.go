@@ -22,6 +22,8 @@ func arrayToCollection(a dgo.Array, path string) []interface{} {
 			s[index] = res.Ref(value.RID(ServiceName))
 		case dgo.Map, dgo.Array:
 			s[index] = res.Ref(path + strconv.Itoa(index))
+		case dgo.Sensitive:
+			s[index] = redacted
 		default:
 			vf.FromValue(value, &s[index])
 		}
@@ -41,6 +43,8 @@ func mapToModel(m dgo.Map, path string) map[string]interface{} {
 			is = res.Ref(v.RID(ServiceName))
 		case dgo.Map, dgo.Array:
 			is = res.Ref(path + ks)
+		case dgo.Sensitive:
+			is = redacted
 		default:
 			vf.FromValue(v, &is)
 		}
@@ -50,13 +54,14 @@ func mapToModel(m dgo.Map, path string) map[string]interface{} {
 }
 
 // Convert an query result in array form into a Resgate collection. All elements that are Arrays and Maps are
-// converted into resource references based on the given path and their index.
-func queryToCollection(a query.Result, path string) []interface{} {
+// converted into resource references based on the given path and their index. Elements are redacted using the
+// given function.
+func queryToCollection(a query.Result, path string, redact func(string, dgo.Value) dgo.Value) []interface{} {
 	st := streamer.New(nil, streamer.DefaultOptions())
 	s := make([]interface{}, a.Len())
 	a.EachWithRefAndIndex(func(value, ref dgo.Value, index int) {
 		dc := streamer.DataCollector()
-		st.Stream(value, dc)
+		st.Stream(redact(path+ref.String(), value), dc)
 		switch value := dc.Value().(type) {
 		case iapi.Resource:
 			s[index] = res.Ref(value.RID(ServiceName))
@@ -70,14 +75,15 @@ func queryToCollection(a query.Result, path string) []interface{} {
 }
 
 // Convert an query result in map form into a Resgate model. All values that are Arrays and Maps are
-// converted into resource references based on the given path and their key in the map.
-func queryToModel(a query.Result, path string) map[string]interface{} {
+// converted into resource references based on the given path and their key in the map. Values are redacted
+// using the given function.
+func queryToModel(a query.Result, path string, redact func(string, dgo.Value) dgo.Value) map[string]interface{} {
 	st := streamer.New(nil, streamer.DefaultOptions())
 	ms := make(map[string]interface{}, a.Len())
 	a.EachWithRefAndIndex(func(value, ref dgo.Value, index int) {
 		rs := ref.(dgo.String).GoString()
 		dc := streamer.DataCollector()
-		st.Stream(value, dc)
+		st.Stream(redact(path+rs, value), dc)
 		var is interface{}
 		switch value := dc.Value().(type) {
 		case iapi.Resource:
@@ -2,11 +2,15 @@
 package inventory
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"io"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jirenius/go-res"
 	"github.com/lyraproj/dgo/dgo"
@@ -14,6 +18,7 @@ import (
 	"github.com/lyraproj/dgo/vf"
 	"github.com/puppetlabs/inventory/change"
 	"github.com/puppetlabs/inventory/iapi"
+	"github.com/puppetlabs/inventory/query"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,6 +26,7 @@ import (
 const ServiceName = `inventory`
 
 const valueKey = `__value`
+const reveal = `reveal`
 const prefix = ServiceName + `.`
 const prefixLen = len(prefix)
 
@@ -33,35 +39,102 @@ type lookupResult struct {
 
 // A Service contains all the resgate handles and a storage.
 type Service struct {
-	resService *res.Service
-	storage    iapi.Storage
+	resService    *res.Service
+	storage       iapi.Storage
+	sensitiveKeys []*regexp.Regexp
+	access        res.AccessHandler
+	authorizer    Authorizer
+	methods       []string
+	timeout       time.Duration
+	watch         io.Closer
 }
 
-// NewService creates a new Resgate service that will use the givne storage
-func NewService(rs *res.Service, storage iapi.Storage) *Service {
-	s := &Service{rs, storage}
+// An Option configures a Service
+type Option func(*Service)
+
+// SensitiveKeys sets the patterns that determine what keys that have sensitive values. A value that is
+// stored under a key that matches one of the patterns is rendered as "[redacted]" in responses and events.
+// The DefaultSensitiveKeys are used when this option isn't given.
+func SensitiveKeys(patterns ...*regexp.Regexp) Option {
+	return func(s *Service) {
+		s.sensitiveKeys = patterns
+	}
+}
+
+// Access sets the handler that determines what access a client has to a resource. The default handler
+// grants access to get resources and to call all methods except "reveal".
+func Access(handler res.AccessHandler) Option {
+	return func(s *Service) {
+		s.access = handler
+	}
+}
+
+// NewService creates a new Resgate service that will use the givne storage. If the storage is an
+// iapi.Watchable, then the service starts watching it and sends events for the changes that it detects.
+func NewService(rs *res.Service, storage iapi.Storage, options ...Option) *Service {
+	s := &Service{resService: rs, storage: storage, sensitiveKeys: DefaultSensitiveKeys, timeout: DefaultRequestTimeout}
+	s.access = s.defaultAccess
+	for _, option := range options {
+		option(s)
+	}
+
 	// Add handlers for "lookup.$key" models. The response will always be a struct
 	// containing a value.
-	rs.Handle(
-		`>`,
-		res.Access(res.AccessGranted),
+	s.methods = []string{`set`, `delete`}
+	opts := []res.Option{
+		res.Access(func(r res.AccessRequest) { s.access(r) }),
 		res.GetResource(s.getHandler),
 		res.Set(s.setHandler),
 		res.Call("delete", s.deleteHandler),
-	)
+		res.Call(reveal, s.revealHandler),
+	}
+	if cs, ok := storage.(iapi.Callable); ok {
+		for _, method := range cs.Methods() {
+			s.methods = append(s.methods, method)
+			opts = append(opts, res.Call(method, s.callHandler(cs, method)))
+		}
+	}
+	rs.Handle(`>`, opts...)
+
+	if ws, ok := storage.(iapi.Watchable); ok {
+		w, err := ws.Watch(context.Background(), s.watchModifications)
+		if err != nil {
+			logrus.Errorf(`unable to watch storage for changes: %s`, err.Error())
+		} else {
+			s.watch = w
+		}
+	}
 	return s
 }
 
-func (s *Service) getComplex(r res.GetRequest) {
+// Close stops watching the storage for changes. It should be called before the res.Service is shut down
+// so that no events are sent during or after the shutdown.
+func (s *Service) Close() error {
+	if s.watch == nil {
+		return nil
+	}
+	w := s.watch
+	s.watch = nil
+	return w.Close()
+}
+
+// defaultAccess grants access to get all resources and to call all methods except reveal
+func (s *Service) defaultAccess(r res.AccessRequest) {
+	r.Access(true, strings.Join(s.methods, `,`))
+}
+
+func (s *Service) getComplex(ctx context.Context, r res.GetRequest) {
 	key := r.ResourceName()
 	hk := key[valuePrefixLen:]
-	mods, result := s.storage.Get(hk)
+	mods, result, err := s.storage.Get(ctx, hk)
 	s.Modifications(mods)
-	if result == nil {
+	if err != nil {
+		sendReadError(r, err)
+	} else if result == nil {
 		r.NotFound()
 	} else {
 		dc := streamer.DataCollector()
-		streamer.New(nil, streamer.DefaultOptions()).Stream(result, dc)
+		streamer.New(nil, streamer.DefaultOptions()).Stream(s.redactAt(key, s.redactExplanation(ctx, hk, result)), dc)
 		v := dc.Value()
 		switch v := v.(type) {
 		case dgo.Array:
@@ -78,8 +151,11 @@ func (s *Service) getComplex(r res.GetRequest) {
 func (s *Service) getHandler(r res.GetRequest) {
 	key := r.ResourceName()
 	logrus.Debugf("Get: %s", key)
+	defer recoverRequest(r)
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
 	if strings.HasPrefix(key, valuePrefix) {
-		s.getComplex(r)
+		s.getComplex(ctx, r)
 		return
 	}
 	if !strings.HasPrefix(key, prefix) {
@@ -88,21 +164,26 @@ func (s *Service) getHandler(r res.GetRequest) {
 	}
 	hk := key[prefixLen:]
 	if r.Query() == `` {
-		s.doGet(r, hk)
+		s.doGet(ctx, r, hk)
 	} else {
-		s.doQuery(r, hk, r.ParseQuery())
+		s.doQuery(ctx, r, hk, r.ParseQuery())
 	}
 }
 
-func (s *Service) normalizeQuery(r res.GetRequest, key string, query url.Values) (string, dgo.Map, bool) {
+func (s *Service) normalizeQuery(r res.GetRequest, key string, values url.Values) (string, dgo.Map, bool) {
 	// Build a normalized (predictable order) query string
 	pqs := strings.Builder{}
 	nqs := s.storage.QueryKeys(key)
 	qvs := vf.MutableMap()
-	for qn := range query {
+	for qn := range values {
 		found := false
 		for _, qp := range nqs {
-			if qn == qp.Name() {
+			if query.Matches(qp, qn) {
+				// A filter on the value of a sensitive key would reveal that value to clients that guess it
+				if qp.Prefix() && s.isSensitiveData(qn[len(qp.Name())+1:]) {
+					r.InvalidQuery(fmt.Sprintf(`parameter '%s' filters on a sensitive key`, qn))
+					return ``, nil, false
+				}
 				found = true
 				break
 			}
@@ -114,69 +195,85 @@ func (s *Service) normalizeQuery(r res.GetRequest, key string, query url.Values)
 	}
 
 	for _, qp := range nqs {
-		qn := qp.Name()
-		qe := query.Get(qn)
-		if qe == `` {
+		qns := []string{qp.Name()}
+		if qp.Prefix() {
+			// All parameters that share the prefix, in alphabetical order
+			qns = qns[:0]
+			for qn := range values {
+				if query.Matches(qp, qn) && values.Get(qn) != `` {
+					qns = append(qns, qn)
+				}
+			}
+			sort.Strings(qns)
+		}
+		if len(qns) == 0 || values.Get(qns[0]) == `` {
 			if qp.Required() {
-				r.InvalidQuery(fmt.Sprintf(`missing required parameter '%s'`, qn))
+				r.InvalidQuery(fmt.Sprintf(`missing required parameter '%s'`, qp.Name()))
 				return ``, nil, false
 			}
 			continue
 		}
-		qvs.Put(qn, vf.New(qp.Type(), vf.Value(qe)))
-		if pqs.Len() > 0 {
-			_ = pqs.WriteByte('&')
+		for _, qn := range qns {
+			qe := values.Get(qn)
+			qvs.Put(qn, vf.New(qp.Type(), vf.Value(qe)))
+			if pqs.Len() > 0 {
+				_ = pqs.WriteByte('&')
+			}
+			_, _ = pqs.WriteString(qn)
+			_ = pqs.WriteByte('=')
+			_, _ = pqs.WriteString(url.QueryEscape(qe))
 		}
-		_, _ = pqs.WriteString(qn)
-		_ = pqs.WriteByte('=')
-		_, _ = pqs.WriteString(url.QueryEscape(qe))
 	}
 	nq := pqs.String()
 	return nq, qvs, true
 }
 
-func (s *Service) doQuery(r res.GetRequest, key string, query url.Values) {
+func (s *Service) doQuery(ctx context.Context, r res.GetRequest, key string, query url.Values) {
 	nq, qvs, ok := s.normalizeQuery(r, key, query)
 	if !ok {
 		return
 	}
-	mods, result := s.storage.Query(key, qvs)
+	mods, result, err := s.storage.Query(ctx, key, qvs)
 	s.Modifications(mods)
-	if result == nil {
+	if err != nil {
+		sendQueryError(r, err)
+	} else if result == nil {
 		r.NotFound()
 	} else {
 		switch {
 		case result.Singleton():
 			var iv interface{}
 			dc := streamer.DataCollector()
-			streamer.New(nil, streamer.DefaultOptions()).Stream(result.Value(0), dc)
+			streamer.New(nil, streamer.DefaultOptions()).Stream(s.redactAt(r.ResourceName(), result.Value(0)), dc)
 			v := dc.Value()
 			vf.FromValue(v, &iv)
 			r.Model(&lookupResult{Value: iv})
 		case result.IsMap():
-			r.QueryModel(queryToModel(result, r.ResourceName()+`.`), nq)
+			r.QueryModel(queryToModel(result, r.ResourceName()+`.`, s.redactAt), nq)
 		default:
-			r.QueryCollection(queryToCollection(result, r.ResourceName()+`.`), nq)
+			r.QueryCollection(queryToCollection(result, r.ResourceName()+`.`, s.redactAt), nq)
 		}
 	}
 }
 
-func (s *Service) doGet(r res.GetRequest, key string) {
-	mods, result := s.storage.Get(key)
+func (s *Service) doGet(ctx context.Context, r res.GetRequest, key string) {
+	mods, result, err := s.storage.Get(ctx, key)
 	s.Modifications(mods)
-	if result == nil {
+	if err != nil {
+		sendReadError(r, err)
+	} else if result == nil {
 		r.NotFound()
 	} else {
-		switch v := result.(type) {
+		switch v := s.redactAt(r.ResourceName(), s.redactExplanation(ctx, key, result)).(type) {
 		case dgo.Array:
 			r.Collection(arrayToCollection(v, r.ResourceName()+`.`))
 		case iapi.Resource:
-			r.Model(mapToModel(v.DataMap(), r.ResourceName()+`.`))
+			r.Model(mapToModel(s.redact(v.DataMap()).(dgo.Map), r.ResourceName()+`.`))
 		case dgo.Map:
 			r.Model(mapToModel(v, r.ResourceName()+`.`))
 		default:
 			dc := streamer.DataCollector()
-			streamer.New(nil, streamer.DefaultOptions()).Stream(result, dc)
+			streamer.New(nil, streamer.DefaultOptions()).Stream(v, dc)
 			var iv interface{}
 			vf.FromValue(dc.Value(), &iv)
 			r.Model(&lookupResult{Value: iv})
@@ -185,39 +282,125 @@ func (s *Service) doGet(r res.GetRequest, key string) {
 }
 
 func (s *Service) deleteHandler(r res.CallRequest) {
+	defer recoverRequest(r)
 	key := r.ResourceName()
 	if !strings.HasPrefix(key, prefix) {
 		r.NotFound()
 		return
 	}
-	mods, ok := s.storage.Delete(key[prefixLen:])
-	s.Modifications(mods)
-	if ok {
-		r.DeleteEvent()
-		r.OK(nil)
-	} else {
-		r.NotFound()
+	hk := key[prefixLen:]
+	if !s.permitted(r, hk, CallAccess) {
+		return
+	}
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+	mods, err := s.storage.Delete(ctx, hk)
+	for _, mod := range mods {
+		// The delete event for the resource itself is sent below
+		if !(mod.Type == change.Delete && mod.ResourceName == hk) {
+			s.sendModificationEvent(mod)
+		}
+	}
+	if err != nil {
+		sendError(r, err)
+		return
 	}
+	r.DeleteEvent()
+	r.OK(nil)
 }
 
 func (s *Service) setHandler(r res.CallRequest) {
+	defer recoverRequest(r)
 	key := r.ResourceName()
 	if !strings.HasPrefix(key, prefix) {
 		r.NotFound()
 		return
 	}
-	if params, ok := streamer.UnmarshalJSON(r.RawParams(), nil).(dgo.Map); ok {
-		mods, err := s.storage.Set(key[prefixLen:], params)
+	if !s.permitted(r, key[prefixLen:], CallAccess) {
+		return
+	}
+	params, err := parseParams(r)
+	if err != nil {
+		sendError(r, err)
+		return
+	}
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+	mods, err := s.storage.Set(ctx, key[prefixLen:], params)
+	s.Modifications(mods)
+	if err != nil {
+		sendError(r, err)
+		return
+	}
+
+	// Send success response
+	r.OK(nil)
+}
+
+func (s *Service) callHandler(cs iapi.Callable, method string) res.CallHandler {
+	return func(r res.CallRequest) {
+		defer recoverRequest(r)
+		key := r.ResourceName()
+		if !strings.HasPrefix(key, prefix) {
+			r.NotFound()
+			return
+		}
+		if !s.permitted(r, key[prefixLen:], CallAccess) {
+			return
+		}
+		params, err := parseParams(r)
 		if err != nil {
-			panic(err)
+			sendError(r, err)
+			return
 		}
+		ctx, cancel := s.requestContext(r)
+		defer cancel()
+		mods, result, err := cs.Call(ctx, key[prefixLen:], method, params)
 		s.Modifications(mods)
+		if err != nil {
+			sendError(r, err)
+			return
+		}
+		var iv interface{}
+		if result != nil {
+			dc := streamer.DataCollector()
+			streamer.New(nil, streamer.DefaultOptions()).Stream(s.redact(result), dc)
+			vf.FromValue(dc.Value(), &iv)
+		}
+		r.OK(iv)
+	}
+}
 
-		// Send success response
-		r.OK(nil)
+// revealHandler responds with the unredacted value of the resource. Maps and Arrays are included in their
+// entirety rather than as resource references.
+func (s *Service) revealHandler(r res.CallRequest) {
+	defer recoverRequest(r)
+	key := r.ResourceName()
+	if !strings.HasPrefix(key, prefix) {
+		r.NotFound()
+		return
+	}
+	if !s.permitted(r, key[prefixLen:], RevealAccess) {
+		return
+	}
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+	mods, result, err := s.storage.Get(ctx, key[prefixLen:])
+	s.Modifications(mods)
+	if err != nil {
+		sendReadError(r, err)
+		return
+	}
+	if result == nil {
+		r.NotFound()
 		return
 	}
-	panic(errors.New(`unable to extract model from parameters`))
+	logrus.Infof(`Reveal: %s`, key)
+	var iv interface{}
+	dc := streamer.DataCollector()
+	streamer.New(nil, streamer.DefaultOptions()).Stream(unwrapSensitive(result), dc)
+	vf.FromValue(dc.Value(), &iv)
+	r.OK(&lookupResult{Value: iv})
 }
 
 // Modifications will send events to subscribers notifying them of the changes described in the
@@ -228,6 +411,12 @@ func (s *Service) Modifications(mods []*change.Modification) {
 	}
 }
 
+// watchModifications sends events for the modifications detected by a watch. The events are sent from a worker
+// goroutine of the res.Service, in the order that they were detected, and discarded unless the service is serving.
+func (s *Service) watchModifications(mods []*change.Modification) {
+	s.resService.WithGroup(ServiceName, func(*res.Service) { s.Modifications(mods) })
+}
+
 func (s *Service) sendModificationEvent(mod *change.Modification) {
 	rid := prefix + mod.ResourceName
 	r, err := s.resService.Resource(rid)
@@ -242,7 +431,7 @@ func (s *Service) sendModificationEvent(mod *change.Modification) {
 		logrus.Debugf(`Reset: %s`, rid)
 		r.ResetEvent()
 	case change.Create:
-		v := convertValue(rid, mod.Value)
+		v := s.convertValue(rid, mod.Value)
 		logrus.Debugf(`Create: %s = %v`, rid, v)
 		r.CreateEvent(v)
 	case change.Change:
@@ -252,13 +441,13 @@ func (s *Service) sendModificationEvent(mod *change.Modification) {
 			if e.Value() == change.Deleted {
 				m[k] = res.DeleteAction
 			} else {
-				m[k] = convertValue(rid+`.`+k, e.Value())
+				m[k] = s.convertValue(rid+`.`+k, e.Value())
 			}
 		})
 		logrus.Debugf(`Change: %s = %v`, rid, m)
 		r.ChangeEvent(m)
 	case change.Add:
-		v := convertValue(rid+`.`+strconv.Itoa(mod.Index), mod.Value)
+		v := s.convertValue(rid+`.`+strconv.Itoa(mod.Index), mod.Value)
 		logrus.Debugf(`Add: %s[%d] = %v`, rid, mod.Index, v)
 		r.AddEvent(v, mod.Index)
 	case change.Remove:
@@ -267,23 +456,23 @@ func (s *Service) sendModificationEvent(mod *change.Modification) {
 	case change.Set:
 		// NOTE: Some confusion here. What should be sent when a collection value is replaced?
 		//  see ticket: https://github.com/resgateio/resgate/issues/145
-		v := convertValue(rid+`.`+strconv.Itoa(mod.Index), mod.Value)
+		v := s.convertValue(rid+`.`+strconv.Itoa(mod.Index), mod.Value)
 		logrus.Debugf(`Set: %s[%d] = %v`, rid, mod.Index, v)
 		r.RemoveEvent(mod.Index)
 		r.AddEvent(v, mod.Index)
 	}
 }
 
-func convertValue(key string, result dgo.Value) interface{} {
+func (s *Service) convertValue(key string, result dgo.Value) interface{} {
 	var iv interface{}
-	switch v := result.(type) {
+	switch v := s.redactAt(key, result).(type) {
 	case iapi.Resource:
 		iv = res.Ref(v.RID(ServiceName))
 	case dgo.Map, dgo.Array:
 		iv = res.Ref(key)
 	default:
 		dc := streamer.DataCollector()
-		streamer.New(nil, streamer.DefaultOptions()).Stream(result, dc)
+		streamer.New(nil, streamer.DefaultOptions()).Stream(v, dc)
 		vf.FromValue(dc.Value(), &iv)
 	}
 	return iv
@@ -1,13 +1,20 @@
 package inventory_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gofrs/flock"
 	"github.com/jirenius/go-res"
 	"github.com/jirenius/go-res/logger"
 	"github.com/jirenius/go-res/test"
@@ -16,8 +23,11 @@ import (
 	"github.com/lyraproj/dgo/streamer"
 	"github.com/lyraproj/dgo/vf"
 	"github.com/lyraproj/dgoyaml/yaml"
+	"github.com/puppetlabs/inventory/bolt"
 	"github.com/puppetlabs/inventory/file"
+	"github.com/puppetlabs/inventory/iapi"
 	"github.com/puppetlabs/inventory/inventory"
+	"github.com/puppetlabs/inventory/pkcs7"
 )
 
 func TestGetFact(t *testing.T) {
@@ -44,18 +54,108 @@ func TestGetFacts(t *testing.T) {
 	shutdownSession(s, cl)
 }
 
+func TestGetSchema(t *testing.T) {
+	s, cl := createSession(staticDir(), t)
+	levels, ok := get("inventory.schema", s, t).(dgo.Map).Get(`levels`).(dgo.Array)
+	require.True(t, ok)
+	require.Equal(t, 3, levels.Len())
+	require.Equal(t,
+		vf.Map(`name`, `nodes`, `type`, `{__value: string, a?: []string, b?: string, ...}`),
+		get(levels.Get(1).(dgo.Map).Get(`rid`).String(), s, t))
+	shutdownSession(s, cl)
+}
+
+func TestQuery_nodes(t *testing.T) {
+	s, cl := createSession(staticDir(), t)
+	m, nq := getQuery(`inventory.realmA.nodes`, `name=B`, s, t)
+	require.Equal(t, vf.Map(`nodeB`, `Node B`), m)
+	require.Equal(t, `name=B`, nq)
+
+	m, _ = getQuery(`inventory.realmA.nodes`, `nameRegexp=A$`, s, t)
+	require.Equal(t, vf.Map(`nodeA`, `Node A`), m)
+
+	m, nq = getQuery(`inventory.realmA.nodes`, `fact.b=value%20of%20b&name=node`, s, t)
+	require.Equal(t, vf.Map(`nodeA`, `Node A`, `nodeB`, `Node B`), m)
+	require.Equal(t, `name=node&fact.b=value+of+b`, nq)
+
+	// Arrays match when they contain the value
+	m, _ = getQuery(`inventory.realmA.nodes`, `fact.a=second`, s, t)
+	require.Equal(t, vf.Map(`nodeA`, `Node A`), m)
+
+	inb := s.Request(`get.inventory.realmA.nodes`, &request{Query: `color=red`})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeInvalidQuery, msg.PathPayload(t, `error.code`))
+	shutdownSession(s, cl)
+}
+
+func TestQuery_acrossRealms(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for _, n := range []struct{ realm, node, family string }{
+		{`realm1`, `node1`, `RedHat`},
+		{`realm1`, `node2`, `Debian`},
+		{`realm2`, `node3`, `RedHat`},
+	} {
+		createLevel(filepath.Join(dir, n.realm), vf.Map(`__value`, n.realm), t)
+		createLevel(filepath.Join(dir, n.realm, n.node), vf.Map(`__value`, n.node, `os`, vf.Map(`family`, n.family)), t)
+	}
+
+	s, cl := createSession(dir, t)
+	require.Equal(t, vf.Map(`realm1.node1`, `node1`, `realm1.node2`, `node2`, `realm2.node3`, `node3`), get(`inventory.nodes`, s, t))
+	m, _ := getQuery(`inventory.nodes`, `fact.os.family=RedHat`, s, t)
+	require.Equal(t, vf.Map(`realm1.node1`, `node1`, `realm2.node3`, `node3`), m)
+	m, _ = getQuery(`inventory.nodes`, `name=2`, s, t)
+	require.Equal(t, vf.Map(`realm1.node2`, `node2`), m)
+	shutdownSession(s, cl)
+}
+
+func TestQuery_invalidRegexp(t *testing.T) {
+	s, cl := createSession(staticDir(), t)
+	inb := s.Request(`get.inventory.realmA.nodes`, &request{Query: `nameRegexp=(`})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeInvalidQuery, msg.PathPayload(t, `error.code`))
+	require.Match(t, `invalid nameRegexp`, msg.PathPayload(t, `error.message`))
+	shutdownSession(s, cl)
+}
+
+func TestQuery_sensitiveFact(t *testing.T) {
+	createNode(`realmQ`, `nodeA`, vf.Map(`ssh`, vf.Map(`user`, `admin`, `password`, `S3cret`)), t)
+	s, cl := createSession(volatileDir(), t)
+	m, _ := getQuery(`inventory.realmQ.nodes`, `fact.ssh.user=admin`, s, t)
+	require.Equal(t, vf.Map(`nodeA`, `nodeA`), m)
+	inb := s.Request(`get.inventory.realmQ.nodes`, &request{Query: `fact.ssh.password=S3cret`})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeInvalidQuery, msg.PathPayload(t, `error.code`))
+	require.Match(t, `sensitive key`, msg.PathPayload(t, `error.message`))
+	shutdownSession(s, cl)
+}
+
 func TestDeleteFact(t *testing.T) {
 	createNode(`realmX`, `nodeA`, vf.Map(`a`, `value of a`), t)
 	s, cl := createSession(volatileDir(), t)
-	remove("inventory.realmX.nodeA.a", s, t)
+	events := remove("inventory.realmX.nodeA.a", s, t)
+	require.Equal(t, 1, len(events))
+	require.Equal(t, `event.inventory.realmX.nodeA.change`, events[0].Subject)
+	require.Equal(t, `delete`, events[0].PathPayload(t, `values.a.action`))
 	shutdownSession(s, cl)
 	ensureNode(`realmX`, `nodeA`, vf.Map(), t)
 }
 
 func TestDeleteNode(t *testing.T) {
-	createNode(`realmX`, `nodeD`, vf.Map(`a`, `value of a`), t)
+	createNode(`realmX`, `nodeD`, vf.Map(`a`, `value of a`, `m`, vf.Map(`x`, 1)), t)
 	s, cl := createSession(volatileDir(), t)
-	remove("inventory.realmX.nodeD", s, t)
+	events := remove("inventory.realmX.nodeD", s, t)
+	require.Equal(t, 3, len(events))
+	require.Equal(t, `event.inventory.realmX.nodeD.m.delete`, events[0].Subject)
+	require.Equal(t, `event.inventory.realmX.nodes.change`, events[1].Subject)
+	require.Equal(t, `delete`, events[1].PathPayload(t, `values.nodeD.action`))
+	require.Equal(t, `event.inventory.nodes.change`, events[2].Subject)
 	shutdownSession(s, cl)
 	ensureNoNode(`realmX`, `nodeD`, t)
 }
@@ -77,8 +177,452 @@ func TestNewNode(t *testing.T) {
 	ensureNode(`realmY`, `nodeB`, vf.Map(), t)
 }
 
+func TestGetEncryptedFact(t *testing.T) {
+	keys := testKeys(t)
+	pw, err := keys.Encrypt([]byte(`S3cretP@ssword`))
+	require.Ok(t, err)
+	createNode(`realmZ`, `nodeE`, vf.Map(`user`, `admin`, `password`, pw), t)
+	s, cl := createStorageSession(file.NewStorageWithKeys(volatileDir(), keys, `realms`, `nodes`, `facts`), t)
+	require.Equal(t, vf.Map(`user`, `admin`, `password`, `[redacted]`), get("inventory.realmZ.nodeE.facts", s, t))
+	require.Equal(t, `[redacted]`, get("inventory.realmZ.nodeE.password", s, t))
+	shutdownSession(s, cl)
+}
+
+func TestGetSensitiveKeys(t *testing.T) {
+	createNode(`realmZ`, `nodeS`, vf.Map(`user`, `admin`, `password`, `S3cret`, `api_token`, `abc`), t)
+	s, cl := createSession(volatileDir(), t)
+	require.Equal(t, vf.Map(`user`, `admin`, `password`, `[redacted]`, `api_token`, `[redacted]`),
+		get("inventory.realmZ.nodeS.facts", s, t))
+	require.Equal(t, `[redacted]`, get("inventory.realmZ.nodeS.password", s, t))
+	shutdownSession(s, cl)
+}
+
+func TestGetSensitiveEntityName(t *testing.T) {
+	createNode(`realmZ`, `tokens-host`, vf.Map(`user`, `admin`, `password`, `S3cret`), t)
+	s, cl := createSession(volatileDir(), t)
+	require.Equal(t, vf.Map(`user`, `admin`, `password`, `[redacted]`), get("inventory.realmZ.tokens-host.facts", s, t))
+	require.Equal(t, `admin`, get("inventory.realmZ.tokens-host.user", s, t))
+	require.Equal(t, `[redacted]`, get("inventory.realmZ.tokens-host.password", s, t))
+	shutdownSession(s, cl)
+}
+
+func TestGetSensitiveExplanation(t *testing.T) {
+	s, cl := createStorageSession(bolt.NewStorage(absTestDir(filepath.Join(`static`, `bolt`))), t)
+	entry := `inventory.target.cmVhbG1fYi5teXRhcmdldA==.explain.config.1`
+	v := get(entry, s, t).(dgo.Map)
+	require.Equal(t, `ssh.password`, v.Get(`key`))
+	require.Equal(t, `[redacted]`, v.Get(`value`))
+	require.Equal(t, vf.Map(`value`, `[redacted]`, `source`, `realm_b/group2`), get(entry+`.overrides.0`, s, t))
+	require.Equal(t, `[redacted]`, get(entry+`.overrides.0.value`, s, t))
+	require.Equal(t, `puppet`, get(`inventory.target.cmVhbG1fYi5teXRhcmdldA==.explain.config.2.value`, s, t))
+	shutdownSession(s, cl)
+}
+
+func TestSetSensitiveKey(t *testing.T) {
+	createNode(`realmZ`, `nodeS`, vf.Map(`user`, `admin`), t)
+	s, cl := createSession(volatileDir(), t)
+	s.Request(`call.inventory.realmZ.nodeS.set`, &request{Params: streamer.MarshalJSON(vf.Map(`password`, `S3cret`), nil)})
+	msg := s.GetMsg(t)
+	require.Equal(t, `event.inventory.realmZ.nodeS.change`, msg.Subject)
+	require.Equal(t, vf.Map(`password`, `[redacted]`), parseMessage(msg, `values`, s, t))
+	shutdownSession(s, cl)
+}
+
+func TestReveal(t *testing.T) {
+	keys := testKeys(t)
+	pw, err := keys.Encrypt([]byte(`S3cretP@ssword`))
+	require.Ok(t, err)
+	createNode(`realmZ`, `nodeE`, vf.Map(`user`, `admin`, `password`, pw), t)
+	s, cl := createStorageSession(file.NewStorageWithKeys(volatileDir(), keys, `realms`, `nodes`, `facts`), t)
+	require.Equal(t, vf.Map(`value`, `S3cretP@ssword`), call("inventory.realmZ.nodeE.password", `reveal`, s, t))
+	require.Equal(t, vf.Map(`value`, vf.Map(`user`, `admin`, `password`, `S3cretP@ssword`)),
+		call("inventory.realmZ.nodeE.facts", `reveal`, s, t))
+	shutdownSession(s, cl)
+}
+
+func TestAccess_default(t *testing.T) {
+	s, cl := createSession(staticDir(), t)
+	inb := s.Request(`access.inventory.realmA`, &request{})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, vf.Map(`get`, true, `call`, `set,delete`), parseMessage(msg, `result`, s, t))
+	shutdownSession(s, cl)
+}
+
+func TestSet_invalidParams(t *testing.T) {
+	s, cl := createSession(staticDir(), t)
+	inb := s.Request(`call.inventory.realmA.nodeA.set`, &request{Params: json.RawMessage(`["a"]`)})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeInvalidParams, msg.PathPayload(t, `error.code`))
+	require.Equal(t, `parameters must be an object`, msg.PathPayload(t, `error.message`))
+	shutdownSession(s, cl)
+}
+
+func TestSet_schemaMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `schema.yaml`), []byte(`levels:
+  - name: realms
+  - name: nodes
+    type: '{__value: string, os?: {family: "RedHat"|"Debian", release?: int}, ...}'
+  - name: facts
+`), 0640))
+	createLevel(filepath.Join(dir, `realmV`), vf.Map(`__value`, `realmV`), t)
+	createLevel(filepath.Join(dir, `realmV`, `nodeA`), vf.Map(`__value`, `nodeA`), t)
+
+	s, cl := createSession(dir, t)
+	set(`inventory.realmV.nodeA`, `change`, vf.Map(`a`, `x`), s, t)
+
+	inb := s.Request(`call.inventory.realmV.nodeA.set`, &request{Params: json.RawMessage(`{"os":{"family":"RedHat","release":"8"}}`)})
+	msg := awaitEvent(inb, s, t)
+	require.Equal(t, res.CodeInvalidParams, msg.PathPayload(t, `error.code`))
+	require.Equal(t,
+		`invalid data for key "realmV.nodeA": os.release: the string "8" cannot be assigned to a variable of type int`,
+		msg.PathPayload(t, `error.message`))
+
+	inb = s.Request(`call.inventory.realmV.nodeB.set`, &request{Params: json.RawMessage(`{"__value":3}`)})
+	msg = awaitEvent(inb, s, t)
+	require.Equal(t, res.CodeInvalidParams, msg.PathPayload(t, `error.code`))
+	require.Equal(t,
+		`invalid data for key "realmV.nodeB": __value: the value 3 cannot be assigned to a variable of type string`,
+		msg.PathPayload(t, `error.message`))
+	_, err = os.Stat(filepath.Join(dir, `realmV`, `nodeB`))
+	require.True(t, os.IsNotExist(err))
+	shutdownSession(s, cl)
+}
+
+func TestDelete_schemaMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `schema.yaml`), []byte(`levels:
+  - name: realms
+  - name: nodes
+    type: '{__value: string, a?: string}'
+  - name: facts
+`), 0640))
+	createLevel(filepath.Join(dir, `realmV`), vf.Map(`__value`, `realmV`), t)
+	createLevel(filepath.Join(dir, `realmV`, `nodeA`), vf.Map(`__value`, `nodeA`, `a`, `x`), t)
+
+	s, cl := createSession(dir, t)
+	inb := s.Request(`call.inventory.realmV.nodeA.__value.delete`, &request{})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeInvalidParams, msg.PathPayload(t, `error.code`))
+	require.Equal(t, `invalid data for key "realmV.nodeA": missing required key "__value"`, msg.PathPayload(t, `error.message`))
+	ensureLevel(filepath.Join(dir, `realmV`, `nodeA`), vf.Map(`a`, `x`), t)
+	shutdownSession(s, cl)
+}
+
+func TestSet_notFound(t *testing.T) {
+	createNode(`realmY`, `nodeA`, vf.Map(`a`, `value of a`), t)
+	s, cl := createSession(volatileDir(), t)
+	inb := s.Request(`call.inventory.realmY.nodeQ.set`, &request{Params: json.RawMessage(`{"a":"b"}`)})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeNotFound, msg.PathPayload(t, `error.code`))
+	require.Match(t, `realmY\.nodeQ`, msg.PathPayload(t, `error.message`))
+	shutdownSession(s, cl)
+}
+
+func TestGet_corruptData(t *testing.T) {
+	createNode(`realmZ`, `nodeA`, vf.Map(`a`, `value of a`), t)
+	require.Ok(t, ioutil.WriteFile(filepath.Join(volatileDir(), `realmZ`, `nodeA`, `data.yaml`), []byte(`a: [`), 0640))
+	s, cl := createSession(volatileDir(), t)
+	inb := s.Request(`get.inventory.realmZ.nodeA.a`, &request{})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeInternalError, msg.PathPayload(t, `error.code`))
+	require.Equal(t, `Internal error`, msg.PathPayload(t, `error.message`))
+	shutdownSession(s, cl)
+}
+
+func TestDelete_notFound(t *testing.T) {
+	createNode(`realmX`, `nodeA`, vf.Map(`a`, `value of a`), t)
+	s, cl := createSession(volatileDir(), t)
+	inb := s.Request(`call.inventory.realmX.nodeA.b.delete`, &request{})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeNotFound, msg.PathPayload(t, `error.code`))
+	shutdownSession(s, cl)
+}
+
+func TestGet_timeout(t *testing.T) {
+	createNode(`realmL`, `nodeA`, vf.Map(`a`, `value of a`), t)
+	lock := flock.New(filepath.Join(volatileDir(), `realmL`, `nodeA`, `data.yaml`))
+	require.Ok(t, lock.Lock())
+	defer func() {
+		_ = lock.Close()
+	}()
+	s, cl := createStorageSession(file.NewStorage(volatileDir(), `realms`, `nodes`, `facts`), t,
+		inventory.RequestTimeout(500*time.Millisecond))
+	inb := s.Request(`get.inventory.realmL.nodeA.a`, &request{})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, `timeout:"500"`, string(msg.Data))
+	msg = s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeTimeout, msg.PathPayload(t, `error.code`))
+	shutdownSession(s, cl)
+}
+
+func TestGet_shortTimeout(t *testing.T) {
+	createNode(`realmL`, `nodeA`, vf.Map(`a`, `value of a`), t)
+	s, cl := createStorageSession(file.NewStorage(volatileDir(), `realms`, `nodes`, `facts`), t,
+		inventory.RequestTimeout(200*time.Millisecond))
+	inb := s.Request(`get.inventory.realmL.nodeA.a`, &request{})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, `timeout:"200"`, string(msg.Data))
+	msg = s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, `value of a`, msg.PathPayload(t, `result.model.value`))
+	shutdownSession(s, cl)
+}
+
+func TestGet_changedAfterCached(t *testing.T) {
+	createNode(`realmK`, `nodeA`, vf.Map(`a`, `x`), t)
+	deleteNode(`realmK`, `nodeB`, t)
+
+	// Make the files old enough to be cached
+	old := time.Now().Add(-time.Hour)
+	realmDir := filepath.Join(volatileDir(), `realmK`)
+	for _, path := range []string{realmDir, filepath.Join(realmDir, `nodeA`), filepath.Join(realmDir, `nodeA`, `data.yaml`)} {
+		require.Ok(t, os.Chtimes(path, old, old))
+	}
+
+	ctx := context.Background()
+	st := file.NewStorage(volatileDir(), `realms`, `nodes`, `facts`)
+	_, v, err := st.Get(ctx, `realmK.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, `x`, v)
+	_, v, err = st.Get(ctx, `realmK.nodes`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(`nodeA`, `nodeA`), v)
+
+	// Same size but new contents
+	createLevel(filepath.Join(realmDir, `nodeA`), vf.Map(`__value`, `nodeA`, `a`, `y`), t)
+	_, v, err = st.Get(ctx, `realmK.nodeA.a`)
+	require.Ok(t, err)
+	require.Equal(t, `y`, v)
+
+	createLevel(filepath.Join(realmDir, `nodeB`), vf.Map(`__value`, `nodeB`), t)
+	_, v, err = st.Get(ctx, `realmK.nodes`)
+	require.Ok(t, err)
+	require.Equal(t, vf.Map(`nodeA`, `nodeA`, `nodeB`, `nodeB`), v)
+}
+
+// The number of processes, goroutines per process, and set calls per goroutine used by TestSet_concurrent
+const stressProcesses = 3
+const stressGoroutines = 8
+const stressSets = 10
+
+// stressTimeout is the time that the processes started by TestSet_concurrent are given to complete
+const stressTimeout = time.Minute
+
+func TestSet_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	createLevel(filepath.Join(dir, `realmS`), vf.Map(`__value`, `realmS`), t)
+	createLevel(filepath.Join(dir, `realmS`, `nodeA`), vf.Map(`__value`, `nodeA`, `a`, `value of a`), t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), stressTimeout)
+	defer cancel()
+	cmds := make([]*exec.Cmd, stressProcesses)
+	outs := make([]*bytes.Buffer, stressProcesses)
+	for i := range cmds {
+		/* #nosec */
+		cmd := exec.CommandContext(ctx, os.Args[0], `-test.run=^TestSet_concurrentProcess$`, `-test.count=1`)
+		cmd.Env = append(os.Environ(), `INVENTORY_STRESS_PROCESS=`+strconv.Itoa(i), `INVENTORY_STRESS_DIR=`+dir)
+		outs[i] = &bytes.Buffer{}
+		cmd.Stdout = outs[i]
+		cmd.Stderr = outs[i]
+		require.Ok(t, cmd.Start())
+		cmds[i] = cmd
+	}
+	setConcurrently(dir, `t`, t)
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("process %d failed: %s\n%s", i, err.Error(), outs[i].String())
+		}
+	}
+
+	// No update may be lost, neither of the existing node nor of the nodes that were created concurrently
+	facts := vf.MutableMap(`a`, `value of a`)
+	created := make([]dgo.Map, stressSets)
+	for i := range created {
+		created[i] = vf.MutableMap()
+	}
+	for _, prefix := range []string{`t`, `p0`, `p1`, `p2`} {
+		for g := 0; g < stressGoroutines; g++ {
+			for i := 0; i < stressSets; i++ {
+				facts.Put(fmt.Sprintf(`%s_%d_%d`, prefix, g, i), i)
+				created[i].Put(fmt.Sprintf(`%s_%d`, prefix, g), g)
+			}
+		}
+	}
+	ensureLevel(filepath.Join(dir, `realmS`, `nodeA`), facts, t)
+	for i, c := range created {
+		ensureLevel(filepath.Join(dir, `realmS`, fmt.Sprintf(`node%d`, i)), c, t)
+	}
+}
+
+// TestSet_concurrentProcess is the process started by TestSet_concurrent
+func TestSet_concurrentProcess(t *testing.T) {
+	p := os.Getenv(`INVENTORY_STRESS_PROCESS`)
+	if p == `` {
+		t.Skip(`only run as a process started by TestSet_concurrent`)
+	}
+	setConcurrently(os.Getenv(`INVENTORY_STRESS_DIR`), `p`+p, t)
+}
+
+// setConcurrently sets distinct keys of realmS.nodeA in the given directory from several goroutines. Each
+// goroutine also creates the nodes realmS.node0 to realmS.node9, which is a change of the value when a node
+// already exists, and sets a distinct key of each. Each goroutine uses its own storage so that the file locks, rather than the storage, serialize
+// the changes.
+func setConcurrently(dir, prefix string, t *testing.T) {
+	wg := &sync.WaitGroup{}
+	for g := 0; g < stressGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			st := file.NewStorage(dir, `realms`, `nodes`, `facts`)
+			for i := 0; i < stressSets; i++ {
+				if _, err := st.Set(context.Background(), `realmS.nodeA`, vf.Map(fmt.Sprintf(`%s_%d_%d`, prefix, g, i), i)); err != nil {
+					t.Error(err)
+					return
+				}
+				node := fmt.Sprintf(`realmS.node%d`, i)
+				if _, err := st.Set(context.Background(), node, vf.Map(`__value`, node)); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := st.Set(context.Background(), node, vf.Map(fmt.Sprintf(`%s_%d`, prefix, g), g)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestCall_conflict(t *testing.T) {
+	s, cl := createStorageSession(bolt.NewStorage(absTestDir(filepath.Join(`static`, `bolt`))), t)
+	inb := s.Request(`call.inventory.realm_a.groups.addGroup`, &request{Params: json.RawMessage(`{"name":"webservers"}`)})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, inventory.CodeConflict, msg.PathPayload(t, `error.code`))
+	require.Match(t, `already exists`, msg.PathPayload(t, `error.message`))
+	shutdownSession(s, cl)
+}
+
+func TestWatch_events(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	rf := filepath.Join(dir, `realm_t.yaml`)
+	require.Ok(t, ioutil.WriteFile(rf, []byte("version: 2\ntargets:\n  - name: t1\n    uri: host1\n"), 0640))
+
+	s, cl := createStorageSession(bolt.NewStorage(dir), t)
+	require.Equal(t, `host1`, get(`inventory.realm_t.t1.uri`, s, t))
+
+	require.Ok(t, ioutil.WriteFile(rf, []byte("version: 2\ntargets:\n  - name: t1\n    uri: host2\n"), 0640))
+	msg := s.GetMsg(t)
+	require.Equal(t, `event.inventory.target.cmVhbG1fdC50MQ==.change`, msg.Subject)
+	require.Equal(t, `host2`, msg.PathPayload(t, `values.uri`))
+	shutdownSession(s, cl)
+}
+
+func TestWatch_fileEvents(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `inventory`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	realmDir := filepath.Join(dir, `realmW`)
+	createLevel(realmDir, vf.Map(`__value`, `realmW`), t)
+	createLevel(filepath.Join(realmDir, `nodeA`), vf.Map(`__value`, `Node A`, `a`, `x`), t)
+
+	s, cl := createStorageSession(file.NewStorage(dir, `realms`, `nodes`, `facts`), t)
+
+	// Give the watch time to perform its initial scan
+	time.Sleep(200 * time.Millisecond)
+	createLevel(filepath.Join(realmDir, `nodeA`), vf.Map(`__value`, `Node A`, `a`, `y`), t)
+	msg := awaitEvent(`event.inventory.realmW.nodeA.change`, s, t)
+	require.Equal(t, `y`, msg.PathPayload(t, `values.a`))
+
+	createLevel(filepath.Join(realmDir, `nodeB`), vf.Map(`__value`, `Node B`), t)
+	msg = awaitEvent(`event.inventory.realmW.nodes.change`, s, t)
+	require.Equal(t, `Node B`, msg.PathPayload(t, `values.nodeB`))
+
+	require.Ok(t, os.RemoveAll(filepath.Join(realmDir, `nodeB`)))
+	awaitEvent(`event.inventory.realmW.nodeB.delete`, s, t)
+	msg = awaitEvent(`event.inventory.realmW.nodes.change`, s, t)
+	require.Equal(t, `delete`, msg.PathPayload(t, `values.nodeB.action`))
+
+	require.Ok(t, ioutil.WriteFile(filepath.Join(dir, `schema.yaml`), []byte("levels:\n  - name: realms\n  - name: nodes\n  - name: facts\n"), 0640))
+	awaitEvent(`event.inventory.schema.create`, s, t)
+	shutdownSession(s, cl)
+}
+
+type authorizerFunc func(token json.RawMessage, key, realm string) inventory.Permission
+
+func (f authorizerFunc) Permission(token json.RawMessage, key, realm string) inventory.Permission {
+	return f(token, key, realm)
+}
+
+// realmPermission grants call access to realmA when the token is "realmA" and read access otherwise
+func realmPermission(token json.RawMessage, key, realm string) inventory.Permission {
+	if string(token) == `"realmA"` && realm == `realmA` {
+		return inventory.CallAccess
+	}
+	return inventory.ReadAccess
+}
+
+func TestAccess_authorized(t *testing.T) {
+	s, cl := createStorageSession(file.NewStorage(staticDir(), `realms`, `nodes`, `facts`), t,
+		inventory.Authorize(authorizerFunc(realmPermission)))
+	inb := s.Request(`access.inventory.realmA.nodeA`, &request{Token: json.RawMessage(`"realmA"`)})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, vf.Map(`get`, true, `call`, `set,delete`), parseMessage(msg, `result`, s, t))
+
+	inb = s.Request(`access.inventory.realmA.nodeA`, &request{})
+	msg = s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, vf.Map(`get`, true), parseMessage(msg, `result`, s, t))
+	shutdownSession(s, cl)
+}
+
+func TestAccess_deniedCall(t *testing.T) {
+	s, cl := createStorageSession(file.NewStorage(staticDir(), `realms`, `nodes`, `facts`), t,
+		inventory.Authorize(authorizerFunc(realmPermission)))
+	inb := s.Request(`call.inventory.realmA.nodeA.a.delete`, &request{})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	require.Equal(t, res.CodeAccessDenied, msg.PathPayload(t, `error.code`))
+	shutdownSession(s, cl)
+}
+
 func createSession(dir string, t *testing.T) (*test.Session, chan struct{}) {
 	t.Helper()
+	return createStorageSession(file.NewStorage(dir, `realms`, `nodes`, `facts`), t)
+}
+
+func createStorageSession(storage iapi.Storage, t *testing.T, options ...inventory.Option) (*test.Session, chan struct{}) {
+	t.Helper()
 
 	var s *test.Session
 	c := test.NewTestConn(false)
@@ -91,11 +635,14 @@ func createSession(dir string, t *testing.T) (*test.Session, chan struct{}) {
 	}
 	cl := make(chan struct{})
 
-	inventory.NewService(r, file.NewStorage(dir, `realms`, `nodes`, `facts`))
+	is := inventory.NewService(r, storage, options...)
 
 	go func() {
 		defer s.StopServer()
 		defer close(cl)
+		defer func() {
+			_ = is.Close()
+		}()
 		if err := r.Serve(c); err != nil {
 			panic("test: failed to start service: " + err.Error())
 		}
@@ -155,6 +702,18 @@ func resolveRefs(v dgo.Value, s *test.Session, t *testing.T, top bool) dgo.Value
 	}
 }
 
+// awaitEvent returns the first message with the given subject. Other messages are skipped.
+func awaitEvent(subject string, s *test.Session, t *testing.T) *test.Msg {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		if msg := s.GetMsg(t); msg.Subject == subject {
+			return msg
+		}
+	}
+	t.Fatalf(`no %s event was received`, subject)
+	return nil
+}
+
 func get(rid string, s *test.Session, t *testing.T) dgo.Value {
 	t.Helper()
 	inb := s.Request(`get.`+rid, &request{})
@@ -174,6 +733,15 @@ type request struct {
 	Query      string              `json:"query,omitempty"`
 }
 
+// getQuery returns the model and the normalized query of the result of querying the given resource
+func getQuery(rid, q string, s *test.Session, t *testing.T) (dgo.Value, string) {
+	t.Helper()
+	inb := s.Request(`get.`+rid, &request{Query: q})
+	msg := s.GetMsg(t)
+	require.Equal(t, msg.Subject, inb)
+	return parseMessage(msg, `result.model`, s, t), msg.PathPayload(t, `result.query`).(string)
+}
+
 func set(rid, ct string, v dgo.Map, s *test.Session, t *testing.T) {
 	t.Helper()
 	s.Request(`call.`+rid+`.set`, &request{Params: streamer.MarshalJSON(v, nil)})
@@ -184,11 +752,27 @@ func set(rid, ct string, v dgo.Map, s *test.Session, t *testing.T) {
 	}
 }
 
-func remove(rid string, s *test.Session, t *testing.T) {
+func call(rid, method string, s *test.Session, t *testing.T) dgo.Value {
 	t.Helper()
-	s.Request(`call.`+rid+`.delete`, &request{})
+	inb := s.Request(`call.`+rid+`.`+method, &request{})
 	msg := s.GetMsg(t)
-	require.Equal(t, msg.Subject, `event.`+rid+`.delete`)
+	require.Equal(t, msg.Subject, inb)
+	return vf.Value(msg.PathPayload(t, `result`))
+}
+
+// remove deletes the given resource and returns the events that were sent before its delete event
+func remove(rid string, s *test.Session, t *testing.T) []*test.Msg {
+	t.Helper()
+	s.Request(`call.`+rid+`.delete`, &request{})
+	var events []*test.Msg
+	for {
+		msg := s.GetMsg(t)
+		if msg.Subject == `event.`+rid+`.delete` {
+			return events
+		}
+		require.Match(t, `\Aevent\.`, msg.Subject)
+		events = append(events, msg)
+	}
 }
 
 func createNode(realm, node string, facts dgo.Map, t *testing.T) {
@@ -223,7 +807,12 @@ func deleteNode(realm, node string, t *testing.T) {
 }
 
 func ensureNode(realm, node string, facts dgo.Map, t *testing.T) {
-	path := filepath.Join(volatileDir(), realm, node, `data.yaml`)
+	ensureLevel(filepath.Join(volatileDir(), realm, node), facts, t)
+}
+
+// ensureLevel asserts that the data.yaml file in the given directory contains the given facts
+func ensureLevel(dir string, facts dgo.Map, t *testing.T) {
+	path := filepath.Join(dir, `data.yaml`)
 	/* #nosec */
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -250,6 +839,14 @@ func ensureNoNode(realm, node string, t *testing.T) {
 	}
 }
 
+func testKeys(t *testing.T) *pkcs7.KeyPair {
+	t.Helper()
+	dir := absTestDir(filepath.Join(`static`, `keys`))
+	kp, err := pkcs7.LoadKeyPair(filepath.Join(dir, `private_key.pkcs7.pem`), filepath.Join(dir, `public_key.pkcs7.pem`))
+	require.Ok(t, err)
+	return kp
+}
+
 func staticDir() string {
 	return absTestDir(filepath.Join(`static`, `file`))
 }
@@ -0,0 +1,41 @@
+package inventory
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultRequestTimeout is the time that Resgate waits for a response to a request unless told otherwise
+const DefaultRequestTimeout = 3 * time.Second
+
+// responseMargin is the part of the request timeout that is reserved for sending the response. The storage
+// operations performed when handling a request must complete within the remaining time. A quarter of the
+// timeout is reserved instead when that is less.
+const responseMargin = 250 * time.Millisecond
+
+// RequestTimeout sets the time that Resgate waits for a response to a request. The storage operations
+// performed when handling a request must complete before this time has passed. Resgate is told to use
+// this timeout unless it is equal to the DefaultRequestTimeout.
+func RequestTimeout(timeout time.Duration) Option {
+	return func(s *Service) {
+		s.timeout = timeout
+	}
+}
+
+// timeoutRequest is implemented by all requests that can tell Resgate how long to wait for the response
+type timeoutRequest interface {
+	Timeout(d time.Duration)
+}
+
+// requestContext returns a context for the storage operations performed when handling the given request. The
+// deadline of the context is derived from the request timeout of the service.
+func (s *Service) requestContext(r timeoutRequest) (context.Context, context.CancelFunc) {
+	if s.timeout != DefaultRequestTimeout {
+		r.Timeout(s.timeout)
+	}
+	margin := responseMargin
+	if q := s.timeout / 4; q < margin {
+		margin = q
+	}
+	return context.WithTimeout(context.Background(), s.timeout-margin)
+}
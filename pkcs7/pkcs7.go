@@ -0,0 +1,335 @@
+// Package pkcs7 contains the encryption and decryption of values using the PKCS7 format that is used by
+// hiera-eyaml. An encrypted value is a string in the form ENC[PKCS7,<base64 encoded PKCS7 enveloped data>].
+package pkcs7
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const encPrefix = `ENC[PKCS7,`
+const encSuffix = `]`
+
+var encPattern = regexp.MustCompile(`\AENC\[PKCS7,[A-Za-z0-9+/=\s]+\]\z`)
+
+var oidData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+var oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+var oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+var oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+var oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+var oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+// A KeyPair contains the private key used when decrypting values, and the certificate with the public key
+// used when encrypting values. Either one may be absent.
+type KeyPair struct {
+	privateKey  *rsa.PrivateKey
+	certificate *x509.Certificate
+}
+
+// IsEncrypted returns true if the given string is in the form ENC[PKCS7,<base64>]
+func IsEncrypted(s string) bool {
+	return encPattern.MatchString(s)
+}
+
+// LoadKeyPair reads the PEM encoded private key and public key certificate from the given files. An empty
+// path means that the corresponding key is absent.
+func LoadKeyPair(privateKeyFile, publicKeyFile string) (*KeyPair, error) {
+	kp := &KeyPair{}
+	if privateKeyFile != `` {
+		block, err := readPEM(privateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if kp.privateKey, err = parsePrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf(`%s: %s`, privateKeyFile, err.Error())
+		}
+	}
+	if publicKeyFile != `` {
+		block, err := readPEM(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if kp.certificate, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf(`%s: %s`, publicKeyFile, err.Error())
+		}
+	}
+	return kp, nil
+}
+
+// CreateKeyPair creates a new RSA private key and a self signed certificate for its public key, and writes
+// them PEM encoded to the given files. Existing files are not overwritten.
+func CreateKeyPair(privateKeyFile, publicKeyFile string) (*KeyPair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: `inventory`},
+		NotBefore:             now,
+		NotAfter:              now.AddDate(50, 0, 0),
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err = writePEM(privateKeyFile, 0600, &pem.Block{Type: `RSA PRIVATE KEY`, Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		return nil, err
+	}
+	if err = writePEM(publicKeyFile, 0644, &pem.Block{Type: `CERTIFICATE`, Bytes: der}); err != nil {
+		return nil, err
+	}
+	return &KeyPair{privateKey: key, certificate: cert}, nil
+}
+
+// Encrypt encrypts the given plain text using the public key and returns it in the form ENC[PKCS7,<base64>]
+func (kp *KeyPair) Encrypt(plain []byte) (string, error) {
+	if kp == nil || kp.certificate == nil {
+		return ``, errors.New(`no public key has been configured for encryption`)
+	}
+	pub, ok := kp.certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return ``, errors.New(`the public key is not an RSA key`)
+	}
+
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return ``, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return ``, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return ``, err
+	}
+	padded := pad(plain, aes.BlockSize)
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return ``, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return ``, err
+	}
+	ed := envelopedData{
+		RecipientInfos: []recipientInfo{{
+			IssuerAndSerialNumber: issuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: kp.certificate.RawIssuer},
+				SerialNumber: kp.certificate.SerialNumber,
+			},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	}
+	edBytes, err := asn1.Marshal(ed)
+	if err != nil {
+		return ``, err
+	}
+	der, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{oidEnvelopedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: edBytes}})
+	if err != nil {
+		return ``, err
+	}
+	return encPrefix + base64.StdEncoding.EncodeToString(der) + encSuffix, nil
+}
+
+// Decrypt decrypts the given string, which must be in the form ENC[PKCS7,<base64>], using the private key
+func (kp *KeyPair) Decrypt(s string) ([]byte, error) {
+	if kp == nil || kp.privateKey == nil {
+		return nil, errors.New(`no private key has been configured for decryption`)
+	}
+	if !IsEncrypted(s) {
+		return nil, errors.New(`value is not in the form ENC[PKCS7,<base64>]`)
+	}
+	b64 := strings.Join(strings.Fields(s[len(encPrefix):len(s)-len(encSuffix)]), ``)
+	der, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	var ci contentInfo
+	if _, err = asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf(`invalid PKCS7 data: %s`, err.Error())
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, errors.New(`PKCS7 data is not enveloped data`)
+	}
+	var ed envelopedData
+	if _, err = asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, fmt.Errorf(`invalid PKCS7 enveloped data: %s`, err.Error())
+	}
+
+	var key []byte
+	for _, ri := range ed.RecipientInfos {
+		if key, err = rsa.DecryptPKCS1v15(rand.Reader, kp.privateKey, ri.EncryptedKey); err == nil {
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.New(`value was not encrypted for the configured key pair`)
+	}
+
+	eci := ed.EncryptedContentInfo
+	switch alg := eci.ContentEncryptionAlgorithm.Algorithm; {
+	case alg.Equal(oidAES128CBC), alg.Equal(oidAES192CBC), alg.Equal(oidAES256CBC):
+	default:
+		return nil, fmt.Errorf(`unsupported content encryption algorithm %s`, alg)
+	}
+	var iv []byte
+	if _, err = asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf(`invalid initialization vector: %s`, err.Error())
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptedContent(eci.EncryptedContent)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(encrypted) == 0 || len(encrypted)%block.BlockSize() != 0 {
+		return nil, errors.New(`invalid encrypted content`)
+	}
+	plain := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, encrypted)
+	return unpad(plain, block.BlockSize())
+}
+
+// encryptedContent returns the encrypted content, which is either a primitive octet string or a constructed
+// sequence of octet strings.
+func encryptedContent(rv asn1.RawValue) ([]byte, error) {
+	if !rv.IsCompound {
+		return rv.Bytes, nil
+	}
+	var content []byte
+	rest := rv.Bytes
+	for len(rest) > 0 {
+		var part []byte
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &part); err != nil {
+			return nil, fmt.Errorf(`invalid encrypted content: %s`, err.Error())
+		}
+		content = append(content, part...)
+	}
+	return content, nil
+}
+
+func pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	return append(append([]byte{}, data...), bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func unpad(data []byte, blockSize int) ([]byte, error) {
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, errors.New(`invalid padding in decrypted content`)
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errors.New(`invalid padding in decrypted content`)
+		}
+	}
+	return data[:len(data)-n], nil
+}
+
+func parsePrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if rk, ok := key.(*rsa.PrivateKey); ok {
+		return rk, nil
+	}
+	return nil, errors.New(`the private key is not an RSA key`)
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	/* #nosec */
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf(`%s: no PEM data found`, path)
+	}
+	return block, nil
+}
+
+func writePEM(path string, mode os.FileMode, block *pem.Block) error {
+	/* #nosec */
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if err = pem.Encode(f, block); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
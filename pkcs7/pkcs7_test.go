@@ -0,0 +1,97 @@
+package pkcs7_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lyraproj/dgo/dgo"
+	require "github.com/lyraproj/dgo/dgo_test"
+	"github.com/lyraproj/dgo/vf"
+	"github.com/puppetlabs/inventory/pkcs7"
+)
+
+// encrypted was produced using openssl smime -encrypt -binary -aes256 -outform DER with the public key in the
+// static test keys.
+const encrypted = `ENC[PKCS7,MIIBoAYJKoZIhvcNAQcDoIIBkTCCAY0CAQAxggFIMIIBRAIBADAsMBQxEjAQBgNVBAMMCWludmVudG9yeQIULNjWmja27652wr1hYa+2urvHvHYwDQYJKoZIhvcNAQEBBQAEggEAAClXqtlkLQvJ/D+Ibb7k70s4F3svG19s6HQIGuBQr83LiyhOHdvX9HKjP1QBfZG/5RHj8mubGTt9LP3xbOnnrHKOKNWEGHFKVa1l2dgjZtn80AcjXkuoRs5g+KFyzHqcdMMe/AbFm2EmRUawslFhzfitfCnpj1W2IQNleg88968BZfT/tiVKq4OlUPP4qfJ/GTyMwaL/L4rfqcwmk4WT/rrzahn34oOl0h7cAX04NG/6Ugxu1RfsvTyaQYc2Bhsu85n4CqScKDLB3BqqHy1sjfY7e5IMcHe6JQUwqa4hBxSp4kQa1pIZ4issWYzgYxpxgtob3OmSGFLH0BxLwnsNTTA8BgkqhkiG9w0BBwEwHQYJYIZIAWUDBAEqBBCvqm1Pst7D67lLuyBQO2BygBBrCAdNPaaM6dO6F32wffgm]`
+
+func TestDecrypt(t *testing.T) {
+	plain, err := testKeys(t).Decrypt(encrypted)
+	require.Ok(t, err)
+	require.Equal(t, `S3cretP@ssword`, string(plain))
+}
+
+func TestEncrypt(t *testing.T) {
+	kp := testKeys(t)
+	enc, err := kp.Encrypt([]byte(`hello`))
+	require.Ok(t, err)
+	require.True(t, pkcs7.IsEncrypted(enc))
+	plain, err := kp.Decrypt(enc)
+	require.Ok(t, err)
+	require.Equal(t, `hello`, string(plain))
+}
+
+func TestCreateKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `keys`)
+	require.Ok(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	privateKey := filepath.Join(dir, `private_key.pkcs7.pem`)
+	publicKey := filepath.Join(dir, `public_key.pkcs7.pem`)
+	_, err = pkcs7.CreateKeyPair(privateKey, publicKey)
+	require.Ok(t, err)
+
+	enc, err := pkcs7.LoadKeyPair(``, publicKey)
+	require.Ok(t, err)
+	s, err := enc.Encrypt([]byte(`hello`))
+	require.Ok(t, err)
+
+	dec, err := pkcs7.LoadKeyPair(privateKey, ``)
+	require.Ok(t, err)
+	plain, err := dec.Decrypt(s)
+	require.Ok(t, err)
+	require.Equal(t, `hello`, string(plain))
+
+	_, err = dec.Encrypt([]byte(`hello`))
+	require.NotNil(t, err)
+
+	_, err = testKeys(t).Decrypt(s)
+	require.NotNil(t, err)
+}
+
+func TestDecryptValues(t *testing.T) {
+	v, err := testKeys(t).DecryptValues(vf.Map(
+		`user`, `admin`,
+		`password`, encrypted,
+		`tokens`, vf.Values(`plain`, vf.Map(`_plugin`, `pkcs7`, `encrypted_value`, encrypted))))
+	require.Ok(t, err)
+	m := v.(dgo.Map)
+	require.Equal(t, `admin`, m.Get(`user`))
+	pw, ok := m.Get(`password`).(dgo.Sensitive)
+	require.True(t, ok)
+	require.Equal(t, `S3cretP@ssword`, pw.Unwrap())
+	tk, ok := m.Get(`tokens`).(dgo.Array).Get(1).(dgo.Sensitive)
+	require.True(t, ok)
+	require.Equal(t, `S3cretP@ssword`, tk.Unwrap())
+}
+
+func TestDecryptValues_noKeys(t *testing.T) {
+	var kp *pkcs7.KeyPair
+	v, err := kp.DecryptValues(vf.Values(encrypted))
+	require.Ok(t, err)
+	require.Equal(t, vf.Values(encrypted), v)
+
+	_, err = kp.DecryptValues(vf.Values(vf.Map(`_plugin`, `pkcs7`, `encrypted_value`, encrypted)))
+	require.NotNil(t, err)
+}
+
+func testKeys(t *testing.T) *pkcs7.KeyPair {
+	t.Helper()
+	dir, err := filepath.Abs(filepath.Join(`..`, `testdata`, `static`, `keys`))
+	require.Ok(t, err)
+	kp, err := pkcs7.LoadKeyPair(filepath.Join(dir, `private_key.pkcs7.pem`), filepath.Join(dir, `public_key.pkcs7.pem`))
+	require.Ok(t, err)
+	return kp
+}
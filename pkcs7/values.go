@@ -0,0 +1,102 @@
+package pkcs7
+
+import (
+	"fmt"
+
+	"github.com/lyraproj/dgo/dgo"
+	"github.com/lyraproj/dgo/vf"
+)
+
+// PluginName is the name used in plugin references to encrypted values, i.e.
+// {_plugin: pkcs7, encrypted_value: ENC[PKCS7,...]}
+const PluginName = `pkcs7`
+
+var pluginKey = vf.String(`_plugin`)
+var encryptedValueKey = vf.String(`encrypted_value`)
+
+// DecryptString decrypts the given ENC[PKCS7,...] string and returns the result as a sensitive string
+func (kp *KeyPair) DecryptString(s string) (dgo.Value, error) {
+	plain, err := kp.Decrypt(s)
+	if err != nil {
+		return nil, err
+	}
+	return vf.Sensitive(vf.String(string(plain))), nil
+}
+
+// DecryptReference decrypts the encrypted_value parameter of a pkcs7 plugin reference and returns the result
+// as a sensitive string
+func (kp *KeyPair) DecryptReference(params dgo.Map) (dgo.Value, error) {
+	ev, ok := params.Get(encryptedValueKey).(dgo.String)
+	if !ok {
+		return nil, fmt.Errorf(`missing required string parameter %q`, encryptedValueKey)
+	}
+	return kp.DecryptString(ev.GoString())
+}
+
+// DecryptValues returns the given value with all ENC[PKCS7,...] strings and all pkcs7 plugin references
+// replaced by sensitive strings that contain the decrypted values. Maps and arrays that contain no encrypted
+// values are returned as is. Encrypted strings are left untouched if the key pair is nil, but a pkcs7 plugin
+// reference is always an error in that case.
+func (kp *KeyPair) DecryptValues(v dgo.Value) (dgo.Value, error) {
+	dv, _, err := kp.decryptValues(v)
+	return dv, err
+}
+
+func (kp *KeyPair) decryptValues(v dgo.Value) (dgo.Value, bool, error) {
+	switch v := v.(type) {
+	case dgo.String:
+		if kp != nil && IsEncrypted(v.GoString()) {
+			dv, err := kp.DecryptString(v.GoString())
+			return dv, true, err
+		}
+	case dgo.Map:
+		if pn, ok := v.Get(pluginKey).(dgo.String); ok && pn.GoString() == PluginName {
+			dv, err := kp.DecryptReference(v)
+			return dv, true, err
+		}
+		var c dgo.Map
+		var err error
+		v.EachEntry(func(e dgo.MapEntry) {
+			if err != nil {
+				return
+			}
+			var ev dgo.Value
+			var changed bool
+			if ev, changed, err = kp.decryptValues(e.Value()); changed {
+				if c == nil {
+					c = v.Copy(false)
+				}
+				c.Put(e.Key(), ev)
+			}
+		})
+		if err != nil || c == nil {
+			return v, false, err
+		}
+		if v.Frozen() {
+			c.Freeze()
+		}
+		return c, true, nil
+	case dgo.Array:
+		var c dgo.Array
+		for i, n := 0, v.Len(); i < n; i++ {
+			ev, changed, err := kp.decryptValues(v.Get(i))
+			if err != nil {
+				return nil, false, err
+			}
+			if changed {
+				if c == nil {
+					c = v.Copy(false)
+				}
+				c.Set(i, ev)
+			}
+		}
+		if c == nil {
+			return v, false, nil
+		}
+		if v.Frozen() {
+			c.Freeze()
+		}
+		return c, true, nil
+	}
+	return v, false, nil
+}
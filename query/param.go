@@ -12,12 +12,17 @@ type Param interface {
 
 	// Required indicates that a query is unacceptable unless it includes a value for this parameter
 	Required() bool
+
+	// Prefix indicates that this parameter stands for all parameters with a name that starts with the name
+	// of this parameter followed by a dot, e.g. "fact.os.family" for the parameter "fact".
+	Prefix() bool
 }
 
 type param struct {
 	n string
 	t dgo.Type
 	r bool
+	p bool
 }
 
 // NewParam creates a new query parameter
@@ -25,6 +30,21 @@ func NewParam(name string, typ dgo.Type, required bool) Param {
 	return &param{n: name, t: typ, r: required}
 }
 
+// NewPrefixParam creates a new query parameter that stands for all parameters with a name that starts with
+// the given name followed by a dot
+func NewPrefixParam(name string, typ dgo.Type, required bool) Param {
+	return &param{n: name, t: typ, r: required, p: true}
+}
+
+// Matches returns true if a query parameter with the given name is described by the given Param
+func Matches(p Param, name string) bool {
+	pn := p.Name()
+	if p.Prefix() {
+		return len(name) > len(pn)+1 && name[:len(pn)] == pn && name[len(pn)] == '.'
+	}
+	return name == pn
+}
+
 func (q *param) Name() string {
 	return q.n
 }
@@ -36,3 +56,7 @@ func (q *param) Type() dgo.Type {
 func (q *param) Required() bool {
 	return q.r
 }
+
+func (q *param) Prefix() bool {
+	return q.p
+}
@@ -2,38 +2,105 @@
 package yaml
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"github.com/lyraproj/dgo/dgo"
 	"github.com/lyraproj/dgoyaml/yaml"
+	"github.com/puppetlabs/inventory/iapi"
 )
 
-// Write a yaml map to the given file. Panic if something goes wrong.
-func Write(path string, pf dgo.Value) {
+// Write a yaml map to the given file. An iapi.InvalidData error is returned if the value cannot be
+// marshalled and an iapi.IOError if the file cannot be written.
+//
+// The file is replaced atomically. The yaml is written to a temporary file named .<name>.<random> in the
+// same directory, which is synced to disk and then renamed to the given path. A reader therefore sees either
+// the old or the new contents, and a crash never leaves a truncated file. The file that a symlink appoints
+// is replaced rather than the symlink itself.
+func Write(path string, pf dgo.Value) error {
 	yml, err := yaml.Marshal(pf)
 	if err != nil {
-		panic(err)
+		return iapi.InvalidData{Reason: fmt.Sprintf(`unable to marshal data for %s: %s`, path, err.Error())}
 	}
-	err = ioutil.WriteFile(path, yml, 0640)
+	if rp, err := filepath.EvalSymlinks(path); err == nil {
+		path = rp
+	}
+	if err = replaceFile(path, yml); err != nil {
+		return iapi.IOError{Path: path, Err: err}
+	}
+	return nil
+}
+
+// replaceFile writes the given data to a temporary file and renames it to the given path. The file retains
+// the permissions of the file that it replaces.
+func replaceFile(path string, data []byte) error {
+	mode := os.FileMode(0640)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, `.`+filepath.Base(path)+`.*`)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
 	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	// Sync the directory so that the rename is persisted. Not all platforms support this.
+	/* #nosec */
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+	return nil
 }
 
-// Read a yaml map from the given file. Panic if something goes wrong.
-func Read(path string) dgo.Map {
+// Read a yaml map from the given file. An iapi.IOError is returned if the file cannot be read and an
+// iapi.InvalidData error if it doesn't contain a valid yaml map.
+func Read(path string) (dgo.Map, error) {
 	/* #nosec */
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, iapi.IOError{Path: path, Err: err}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, iapi.InvalidData{Reason: fmt.Sprintf(`the file %q does not contain a map of values`, path)}
 	}
-	dv, err := yaml.Unmarshal(data)
+	dv, err := unmarshal(data)
 	if err != nil {
-		panic(err)
+		return nil, iapi.InvalidData{Reason: fmt.Sprintf(`the file %q contains invalid yaml: %s`, path, err.Error())}
 	}
 	if dh, ok := dv.(dgo.Map); ok {
-		return dh
+		return dh, nil
 	}
-	panic(fmt.Errorf(`the file %q does not contain a map of values`, path))
+	return nil, iapi.InvalidData{Reason: fmt.Sprintf(`the file %q does not contain a map of values`, path)}
+}
+
+// unmarshal unmarshals the given data. The parser panics on some input, so a panic is recovered and returned
+// as an error.
+func unmarshal(data []byte) (dv dgo.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf(`%v`, r)
+		}
+	}()
+	return yaml.Unmarshal(data)
 }